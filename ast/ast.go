@@ -0,0 +1,299 @@
+// Package ast declares the syntax tree of a Lox program, as built by
+// compiler.Parse and compiled by compiler.CompileFile.
+//
+// Nodes record the position of the tokens the compiler positions bytecode
+// at, so compiling a tree gives the same chunk as compiling its source.
+package ast
+
+import "github.com/jeroendm/glox/chunk"
+
+// All nodes implement Node.
+type Node interface {
+	Pos() chunk.Position // position of the first token of the node
+	End() chunk.Position // position of the last token of the node
+}
+
+// All expression nodes implement Expr.
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// All statement and declaration nodes implement Stmt.
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// Expressions.
+type (
+	// A name of a variable, property, function, class or parameter.
+	Ident struct {
+		NamePos chunk.Position
+		Name    string
+	}
+
+	// An expression with a syntax error, in place of the expression that was
+	// expected at From.
+	BadExpr struct {
+		From chunk.Position
+	}
+
+	NumberLit struct {
+		ValuePos chunk.Position
+		Value    string // as written in the source
+	}
+
+	StringLit struct {
+		ValuePos chunk.Position
+		Value    string // without the quotes
+	}
+
+	BoolLit struct {
+		ValuePos chunk.Position
+		Value    bool
+	}
+
+	NilLit struct {
+		ValuePos chunk.Position
+	}
+
+	ParenExpr struct {
+		Lparen chunk.Position
+		X      Expr
+		Rparen chunk.Position
+	}
+
+	UnaryExpr struct {
+		OpPos chunk.Position
+		Op    string // "!" or "-"
+		X     Expr
+	}
+
+	// A binary operation, including the logical operators "and" and "or".
+	BinaryExpr struct {
+		X     Expr
+		OpPos chunk.Position
+		Op    string
+		Y     Expr
+	}
+
+	// Assignment to a variable.
+	AssignExpr struct {
+		Name  *Ident
+		Value Expr
+	}
+
+	CallExpr struct {
+		Fun    Expr
+		Lparen chunk.Position
+		Args   []Expr
+		Rparen chunk.Position
+	}
+
+	// A property of an instance. Called directly, as in x.method(), it
+	// compiles to a single method invocation.
+	GetExpr struct {
+		X    Expr
+		Name *Ident
+	}
+
+	// Assignment to a property of an instance.
+	SetExpr struct {
+		X     Expr
+		Name  *Ident
+		Value Expr
+	}
+
+	ThisExpr struct {
+		Keyword chunk.Position
+	}
+
+	// A method of the superclass, as in super.method.
+	SuperExpr struct {
+		Keyword chunk.Position
+		Method  *Ident
+	}
+)
+
+// Statements and declarations.
+type (
+	// An expression evaluated for its side effects.
+	ExprStmt struct {
+		X         Expr
+		Semicolon chunk.Position
+	}
+
+	PrintStmt struct {
+		Print     chunk.Position
+		X         Expr
+		Semicolon chunk.Position
+	}
+
+	VarDecl struct {
+		Var       chunk.Position
+		Name      *Ident
+		Init      Expr // nil if the variable is not initialized
+		Semicolon chunk.Position
+	}
+
+	BlockStmt struct {
+		Lbrace chunk.Position
+		List   []Stmt
+		Rbrace chunk.Position
+	}
+
+	IfStmt struct {
+		If     chunk.Position
+		Cond   Expr
+		Rparen chunk.Position
+		Then   Stmt
+		Else   Stmt // nil if there is no else branch
+	}
+
+	WhileStmt struct {
+		While  chunk.Position
+		Cond   Expr
+		Rparen chunk.Position
+		Body   Stmt
+	}
+
+	// All three clauses are optional.
+	ForStmt struct {
+		For       chunk.Position
+		Init      Stmt // a *VarDecl or an *ExprStmt
+		Cond      Expr
+		Semicolon chunk.Position // after the condition
+		Post      Expr
+		Rparen    chunk.Position
+		Body      Stmt
+	}
+
+	ReturnStmt struct {
+		Return    chunk.Position
+		Result    Expr // nil if no value is returned
+		Semicolon chunk.Position
+	}
+
+	// A function declaration, or a method in a class declaration.
+	FunDecl struct {
+		Fun    chunk.Position // zero for methods
+		Name   *Ident
+		Params []*Ident
+		Body   *BlockStmt
+	}
+
+	ClassDecl struct {
+		Class      chunk.Position
+		Name       *Ident
+		Superclass *Ident // nil if the class does not inherit
+		Lbrace     chunk.Position
+		Methods    []*FunDecl
+		Rbrace     chunk.Position
+	}
+)
+
+// A File is a complete script.
+type File struct {
+	Decls []Stmt
+	EOF   chunk.Position
+}
+
+func (x *Ident) Pos() chunk.Position      { return x.NamePos }
+func (x *BadExpr) Pos() chunk.Position    { return x.From }
+func (x *NumberLit) Pos() chunk.Position  { return x.ValuePos }
+func (x *StringLit) Pos() chunk.Position  { return x.ValuePos }
+func (x *BoolLit) Pos() chunk.Position    { return x.ValuePos }
+func (x *NilLit) Pos() chunk.Position     { return x.ValuePos }
+func (x *ParenExpr) Pos() chunk.Position  { return x.Lparen }
+func (x *UnaryExpr) Pos() chunk.Position  { return x.OpPos }
+func (x *BinaryExpr) Pos() chunk.Position { return x.X.Pos() }
+func (x *AssignExpr) Pos() chunk.Position { return x.Name.Pos() }
+func (x *CallExpr) Pos() chunk.Position   { return x.Fun.Pos() }
+func (x *GetExpr) Pos() chunk.Position    { return x.X.Pos() }
+func (x *SetExpr) Pos() chunk.Position    { return x.X.Pos() }
+func (x *ThisExpr) Pos() chunk.Position   { return x.Keyword }
+func (x *SuperExpr) Pos() chunk.Position  { return x.Keyword }
+
+func (x *Ident) End() chunk.Position      { return x.NamePos }
+func (x *BadExpr) End() chunk.Position    { return x.From }
+func (x *NumberLit) End() chunk.Position  { return x.ValuePos }
+func (x *StringLit) End() chunk.Position  { return x.ValuePos }
+func (x *BoolLit) End() chunk.Position    { return x.ValuePos }
+func (x *NilLit) End() chunk.Position     { return x.ValuePos }
+func (x *ParenExpr) End() chunk.Position  { return x.Rparen }
+func (x *UnaryExpr) End() chunk.Position  { return x.X.End() }
+func (x *BinaryExpr) End() chunk.Position { return x.Y.End() }
+func (x *AssignExpr) End() chunk.Position { return x.Value.End() }
+func (x *CallExpr) End() chunk.Position   { return x.Rparen }
+func (x *GetExpr) End() chunk.Position    { return x.Name.End() }
+func (x *SetExpr) End() chunk.Position    { return x.Value.End() }
+func (x *ThisExpr) End() chunk.Position   { return x.Keyword }
+func (x *SuperExpr) End() chunk.Position  { return x.Method.End() }
+
+func (s *ExprStmt) Pos() chunk.Position   { return s.X.Pos() }
+func (s *PrintStmt) Pos() chunk.Position  { return s.Print }
+func (s *VarDecl) Pos() chunk.Position    { return s.Var }
+func (s *BlockStmt) Pos() chunk.Position  { return s.Lbrace }
+func (s *IfStmt) Pos() chunk.Position     { return s.If }
+func (s *WhileStmt) Pos() chunk.Position  { return s.While }
+func (s *ForStmt) Pos() chunk.Position    { return s.For }
+func (s *ReturnStmt) Pos() chunk.Position { return s.Return }
+func (s *FunDecl) Pos() chunk.Position {
+	if s.Fun == (chunk.Position{}) {
+		return s.Name.Pos()
+	}
+	return s.Fun
+}
+func (s *ClassDecl) Pos() chunk.Position { return s.Class }
+
+func (s *ExprStmt) End() chunk.Position  { return s.Semicolon }
+func (s *PrintStmt) End() chunk.Position { return s.Semicolon }
+func (s *VarDecl) End() chunk.Position   { return s.Semicolon }
+func (s *BlockStmt) End() chunk.Position { return s.Rbrace }
+func (s *IfStmt) End() chunk.Position {
+	if s.Else != nil {
+		return s.Else.End()
+	}
+	return s.Then.End()
+}
+func (s *WhileStmt) End() chunk.Position  { return s.Body.End() }
+func (s *ForStmt) End() chunk.Position    { return s.Body.End() }
+func (s *ReturnStmt) End() chunk.Position { return s.Semicolon }
+func (s *FunDecl) End() chunk.Position    { return s.Body.End() }
+func (s *ClassDecl) End() chunk.Position  { return s.Rbrace }
+
+func (f *File) Pos() chunk.Position {
+	if len(f.Decls) > 0 {
+		return f.Decls[0].Pos()
+	}
+	return f.EOF
+}
+func (f *File) End() chunk.Position { return f.EOF }
+
+func (*Ident) exprNode()      {}
+func (*BadExpr) exprNode()    {}
+func (*NumberLit) exprNode()  {}
+func (*StringLit) exprNode()  {}
+func (*BoolLit) exprNode()    {}
+func (*NilLit) exprNode()     {}
+func (*ParenExpr) exprNode()  {}
+func (*UnaryExpr) exprNode()  {}
+func (*BinaryExpr) exprNode() {}
+func (*AssignExpr) exprNode() {}
+func (*CallExpr) exprNode()   {}
+func (*GetExpr) exprNode()    {}
+func (*SetExpr) exprNode()    {}
+func (*ThisExpr) exprNode()   {}
+func (*SuperExpr) exprNode()  {}
+
+func (*ExprStmt) stmtNode()   {}
+func (*PrintStmt) stmtNode()  {}
+func (*VarDecl) stmtNode()    {}
+func (*BlockStmt) stmtNode()  {}
+func (*IfStmt) stmtNode()     {}
+func (*WhileStmt) stmtNode()  {}
+func (*ForStmt) stmtNode()    {}
+func (*ReturnStmt) stmtNode() {}
+func (*FunDecl) stmtNode()    {}
+func (*ClassDecl) stmtNode()  {}
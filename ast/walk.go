@@ -0,0 +1,126 @@
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is called for each node found by Walk. If the
+// result w is not nil, Walk visits each child of the node with w, followed by
+// a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree in depth-first order: it calls v.Visit(node), then
+// walks each child of the node with the visitor returned by Visit. Optional
+// children that are nil are skipped.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Ident, *BadExpr, *NumberLit, *StringLit, *BoolLit, *NilLit, *ThisExpr:
+		// No children.
+	case *ParenExpr:
+		Walk(v, n.X)
+	case *UnaryExpr:
+		Walk(v, n.X)
+	case *BinaryExpr:
+		Walk(v, n.X)
+		Walk(v, n.Y)
+	case *AssignExpr:
+		Walk(v, n.Name)
+		Walk(v, n.Value)
+	case *CallExpr:
+		Walk(v, n.Fun)
+		for _, arg := range n.Args {
+			Walk(v, arg)
+		}
+	case *GetExpr:
+		Walk(v, n.X)
+		Walk(v, n.Name)
+	case *SetExpr:
+		Walk(v, n.X)
+		Walk(v, n.Name)
+		Walk(v, n.Value)
+	case *SuperExpr:
+		Walk(v, n.Method)
+
+	case *ExprStmt:
+		Walk(v, n.X)
+	case *PrintStmt:
+		Walk(v, n.X)
+	case *VarDecl:
+		Walk(v, n.Name)
+		if n.Init != nil {
+			Walk(v, n.Init)
+		}
+	case *BlockStmt:
+		walkList(v, n.List)
+	case *IfStmt:
+		Walk(v, n.Cond)
+		Walk(v, n.Then)
+		if n.Else != nil {
+			Walk(v, n.Else)
+		}
+	case *WhileStmt:
+		Walk(v, n.Cond)
+		Walk(v, n.Body)
+	case *ForStmt:
+		if n.Init != nil {
+			Walk(v, n.Init)
+		}
+		if n.Cond != nil {
+			Walk(v, n.Cond)
+		}
+		if n.Post != nil {
+			Walk(v, n.Post)
+		}
+		Walk(v, n.Body)
+	case *ReturnStmt:
+		if n.Result != nil {
+			Walk(v, n.Result)
+		}
+	case *FunDecl:
+		Walk(v, n.Name)
+		for _, param := range n.Params {
+			Walk(v, param)
+		}
+		Walk(v, n.Body)
+	case *ClassDecl:
+		Walk(v, n.Name)
+		if n.Superclass != nil {
+			Walk(v, n.Superclass)
+		}
+		for _, method := range n.Methods {
+			Walk(v, method)
+		}
+	case *File:
+		walkList(v, n.Decls)
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkList(v Visitor, list []Stmt) {
+	for _, node := range list {
+		Walk(v, node)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses the tree in depth-first order: it calls f(node), and if
+// f returns true, inspects each child of the node followed by a call of
+// f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
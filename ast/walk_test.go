@@ -0,0 +1,108 @@
+package ast_test
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jeroendm/glox/ast"
+	"github.com/jeroendm/glox/compiler"
+)
+
+func parse(t *testing.T, source string) *ast.File {
+	t.Helper()
+	file, err := compiler.Parse([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestInspect(t *testing.T) {
+	file := parse(t, `
+class A < B {
+  init(x) { this.x = x; }
+  f(a, b) {
+    for (var i = 0; i < a; i = i + 1) {
+      if (i > b) return super.m(i); else print nil;
+    }
+    while (true) b = !a or "s";
+  }
+}`)
+
+	var names []string
+	ast.Inspect(file, func(node ast.Node) bool {
+		if id, ok := node.(*ast.Ident); ok {
+			names = append(names, id.Name)
+		}
+		return true
+	})
+	expected := []string{"A", "B", "init", "x", "x", "x", "f", "a", "b", "i", "i", "a", "i", "i", "i", "b", "m", "i", "b", "a"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected identifiers %v, got %v", expected, names)
+	}
+}
+
+// The children are visited in source order, each followed by Visit(nil).
+type tracer struct {
+	b     *strings.Builder
+	depth int
+}
+
+func (v tracer) Visit(node ast.Node) ast.Visitor {
+	if node == nil {
+		return nil
+	}
+	fmt.Fprintf(v.b, "%s%T %v\n", strings.Repeat(". ", v.depth), node, node.Pos())
+	return tracer{v.b, v.depth + 1}
+}
+
+func TestWalk(t *testing.T) {
+	var b strings.Builder
+	ast.Walk(tracer{b: &b}, parse(t, "var a = 1;\nprint (a + 2) * -a;"))
+
+	expected := `*ast.File 1:1
+. *ast.VarDecl 1:1
+. . *ast.Ident 1:5
+. . *ast.NumberLit 1:9
+. *ast.PrintStmt 2:1
+. . *ast.BinaryExpr 2:7
+. . . *ast.ParenExpr 2:7
+. . . . *ast.BinaryExpr 2:8
+. . . . . *ast.Ident 2:8
+. . . . . *ast.NumberLit 2:12
+. . . *ast.UnaryExpr 2:17
+. . . . *ast.Ident 2:18
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestInspectSkipsChildren(t *testing.T) {
+	var count int
+	ast.Inspect(parse(t, "fun f(a) { print a; } print 1;"), func(node ast.Node) bool {
+		if node != nil {
+			count++
+		}
+		_, isFunction := node.(*ast.FunDecl)
+		return !isFunction
+	})
+	// File, FunDecl, PrintStmt and NumberLit.
+	if count != 4 {
+		t.Errorf("expected 4 nodes, got %d", count)
+	}
+}
+
+func TestEnd(t *testing.T) {
+	file := parse(t, "if (a)\n  print a;\nelse {\n  b = c.d;\n}")
+	stmt := file.Decls[0].(*ast.IfStmt)
+	if end := stmt.End(); end.Line != 5 || end.Column != 1 {
+		t.Errorf("expected the if statement to end at 5:1, got %v", end)
+	}
+	assign := stmt.Else.(*ast.BlockStmt).List[0].(*ast.ExprStmt).X
+	if pos, end := assign.Pos(), assign.End(); pos.String() != "4:3" || end.String() != "4:9" {
+		t.Errorf("expected the assignment at 4:3 to 4:9, got %v to %v", pos, end)
+	}
+}
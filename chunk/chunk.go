@@ -11,10 +11,21 @@ import (
 type OpCode uint8
 
 const (
-	OP_CONSTANT OpCode = iota
-	OP_NIL             // push nil literal on stack
-	OP_TRUE            // push true literal on stack
-	OP_FALSE           // push false literal on stack
+	OP_CONSTANT      OpCode = iota
+	OP_NIL                  // push nil literal on stack
+	OP_TRUE                 // push true literal on stack
+	OP_FALSE                // push false literal on stack
+	OP_POP                  // discard the top of the stack
+	OP_GET_LOCAL            // push local, operand is the stack slot
+	OP_SET_LOCAL            // assign top of stack to local, leaves value on stack
+	OP_GET_GLOBAL           // push global, operand is the name's constant index
+	OP_DEFINE_GLOBAL        // pop value into a new global
+	OP_SET_GLOBAL           // assign top of stack to existing global, leaves value on stack
+	OP_GET_UPVALUE          // push captured variable, operand is the closure's upvalue index
+	OP_SET_UPVALUE          // assign top of stack to captured variable, leaves value on stack
+	OP_GET_PROPERTY         // replace instance on top of stack with field, operand is the name's constant index
+	OP_SET_PROPERTY         // assign top of stack to field of instance below it, leaves value on stack
+	OP_GET_SUPER            // replace superclass and receiver with bound superclass method, operand is the name's constant index
 	OP_EQUAL
 	OP_GREATER
 	OP_LESS
@@ -24,18 +35,46 @@ const (
 	OP_DIVIDE
 	OP_NOT
 	OP_NEGATE
+	OP_PRINT         // pop and print the top of the stack
+	OP_JUMP          // unconditional forward jump, 16-bit operand
+	OP_JUMP_IF_FALSE // forward jump if top of stack is falsey, leaves condition on stack
+	OP_LOOP          // unconditional backward jump, 16-bit operand
+	OP_CALL          // call the callee below the arguments, operand is the argument count
+	OP_CLOSURE       // wrap function constant in a closure, followed by (isLocal, index) per upvalue
+	OP_CLOSE_UPVALUE // move the local on top of the stack into its upvalue and pop it
+	OP_CLASS         // push new class, operand is the name's constant index
+	OP_METHOD        // pop closure into the methods of the class below it, operand is the name's constant index
+	OP_INVOKE        // call method on receiver below the arguments, operands are the name's constant index and argument count
+	OP_SUPER_INVOKE  // like OP_INVOKE, but pops the superclass to look up the method in
+	OP_INHERIT       // copy methods of superclass into subclass on top of stack and pop the subclass
 	OP_RETURN
 )
 
+// A Position in the source code. Column and Offset are zero when only the
+// line is known, as for chunks read with ParseByteCode.
+type Position struct {
+	Line   int
+	Column int // starting at 1
+	Offset int // in bytes from the start of the source
+}
+
+// Format the position as "line:column", or just the line if the column is unknown.
+func (pos Position) String() string {
+	if pos.Column == 0 {
+		return strconv.Itoa(pos.Line)
+	}
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
 type Chunk struct {
 	Code      []uint8
 	Constants []Value
-	Lines     []int
+	Positions []Position // source position of each byte of code
 }
 
-func (chunk *Chunk) Write(code uint8, line int) {
+func (chunk *Chunk) Write(code uint8, pos Position) {
 	chunk.Code = append(chunk.Code, uint8(code))
-	chunk.Lines = append(chunk.Lines, line)
+	chunk.Positions = append(chunk.Positions, pos)
 }
 
 func MakeChunk() Chunk {
@@ -43,74 +82,158 @@ func MakeChunk() Chunk {
 	return Chunk{
 		make([]uint8, 0, initCapacity),
 		make([]Value, 0, initCapacity),
-		make([]int, 0, initCapacity),
+		make([]Position, 0, initCapacity),
 	}
 }
 
-func (chunk *Chunk) printSimpleInstruction(label string, offset int) int {
-	fmt.Println(label)
+func (chunk *Chunk) printSimpleInstruction(w io.Writer, label string, offset int) int {
+	fmt.Fprintln(w, label)
 	return offset + 1
 }
 
-func (chunk *Chunk) printConstantInstruction(name string, offset int) int {
+func (chunk *Chunk) printConstantInstruction(w io.Writer, name string, offset int) int {
 	constant := chunk.Code[offset+1]
-	fmt.Printf("%-16s %4d '", name, constant)
-	PrintValue(chunk.Constants[constant])
-	fmt.Printf("'\n")
+	fmt.Fprintf(w, "%-16s %4d '", name, constant)
+	FprintValue(w, chunk.Constants[constant])
+	fmt.Fprintf(w, "'\n")
 	return offset + 2
 }
 
-func (chunk *Chunk) DisassembleInstruction(offset int) int {
-	// fmt.Printf("constants: %v\n", chunk.Constants)
-	fmt.Printf("%04d ", offset)
+func (chunk *Chunk) printByteInstruction(w io.Writer, name string, offset int) int {
+	slot := chunk.Code[offset+1]
+	fmt.Fprintf(w, "%-16s %4d\n", name, slot)
+	return offset + 2
+}
+
+// Print the jump source and target, sign is -1 for backward jumps.
+func (chunk *Chunk) printJumpInstruction(w io.Writer, name string, sign int, offset int) int {
+	jump := int(chunk.Code[offset+1])<<8 | int(chunk.Code[offset+2])
+	fmt.Fprintf(w, "%-16s %04d -> %04d\n", name, offset, offset+3+sign*jump)
+	return offset + 3
+}
+
+// Print the function constant and, on separate lines, where each of its upvalues is captured from.
+func (chunk *Chunk) printClosureInstruction(w io.Writer, name string, offset int) int {
+	offset = chunk.printConstantInstruction(w, name, offset)
+	function := chunk.Constants[chunk.Code[offset-1]].AsFunction()
+	for j := 0; j < function.UpvalueCount; j++ {
+		isLocal := chunk.Code[offset]
+		index := chunk.Code[offset+1]
+		kind := "upvalue"
+		if isLocal == 1 {
+			kind = "local"
+		}
+		fmt.Fprintf(w, "%04d      |                     %s %d\n", offset, kind, index)
+		offset += 2
+	}
+	return offset
+}
+
+func (chunk *Chunk) printInvokeInstruction(w io.Writer, name string, offset int) int {
+	constant := chunk.Code[offset+1]
+	argCount := chunk.Code[offset+2]
+	fmt.Fprintf(w, "%-16s (%d args) %4d '", name, argCount, constant)
+	FprintValue(w, chunk.Constants[constant])
+	fmt.Fprintf(w, "'\n")
+	return offset + 3
+}
+
+func (chunk *Chunk) DisassembleInstruction(w io.Writer, offset int) int {
+	fmt.Fprintf(w, "%04d ", offset)
 
-	if offset > 0 && chunk.Lines[offset] == chunk.Lines[offset-1] {
-		fmt.Printf("   | ")
+	if offset > 0 && chunk.Positions[offset].Line == chunk.Positions[offset-1].Line {
+		fmt.Fprintf(w, "   | ")
 	} else {
-		fmt.Printf("%4d ", chunk.Lines[offset])
+		fmt.Fprintf(w, "%4d ", chunk.Positions[offset].Line)
 	}
 
 	c := OpCode(chunk.Code[offset])
 	switch c {
 	case OP_CONSTANT:
-		offset = chunk.printConstantInstruction("OP_CONSTANT", offset)
+		offset = chunk.printConstantInstruction(w, "OP_CONSTANT", offset)
 	case OP_NIL:
-		offset = chunk.printSimpleInstruction("OP_NIL", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_NIL", offset)
 	case OP_TRUE:
-		offset = chunk.printSimpleInstruction("OP_TRUE", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_TRUE", offset)
 	case OP_FALSE:
-		offset = chunk.printSimpleInstruction("OP_FALSE", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_FALSE", offset)
+	case OP_POP:
+		offset = chunk.printSimpleInstruction(w, "OP_POP", offset)
+	case OP_GET_LOCAL:
+		offset = chunk.printByteInstruction(w, "OP_GET_LOCAL", offset)
+	case OP_SET_LOCAL:
+		offset = chunk.printByteInstruction(w, "OP_SET_LOCAL", offset)
+	case OP_GET_GLOBAL:
+		offset = chunk.printConstantInstruction(w, "OP_GET_GLOBAL", offset)
+	case OP_DEFINE_GLOBAL:
+		offset = chunk.printConstantInstruction(w, "OP_DEFINE_GLOBAL", offset)
+	case OP_SET_GLOBAL:
+		offset = chunk.printConstantInstruction(w, "OP_SET_GLOBAL", offset)
+	case OP_GET_UPVALUE:
+		offset = chunk.printByteInstruction(w, "OP_GET_UPVALUE", offset)
+	case OP_SET_UPVALUE:
+		offset = chunk.printByteInstruction(w, "OP_SET_UPVALUE", offset)
+	case OP_GET_PROPERTY:
+		offset = chunk.printConstantInstruction(w, "OP_GET_PROPERTY", offset)
+	case OP_SET_PROPERTY:
+		offset = chunk.printConstantInstruction(w, "OP_SET_PROPERTY", offset)
+	case OP_GET_SUPER:
+		offset = chunk.printConstantInstruction(w, "OP_GET_SUPER", offset)
 	case OP_EQUAL:
-		offset = chunk.printSimpleInstruction("OP_EQUAL", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_EQUAL", offset)
 	case OP_GREATER:
-		offset = chunk.printSimpleInstruction("OP_GREATER", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_GREATER", offset)
 	case OP_LESS:
-		offset = chunk.printSimpleInstruction("OP_LESS", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_LESS", offset)
 	case OP_ADD:
-		offset = chunk.printSimpleInstruction("ADD", offset)
+		offset = chunk.printSimpleInstruction(w, "ADD", offset)
 	case OP_SUBTRACT:
-		offset = chunk.printSimpleInstruction("OP_SUBTRACT", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_SUBTRACT", offset)
 	case OP_MULTIPLY:
-		offset = chunk.printSimpleInstruction("OP_MULTIPLY", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_MULTIPLY", offset)
 	case OP_DIVIDE:
-		offset = chunk.printSimpleInstruction("OP_DIVIDE", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_DIVIDE", offset)
 	case OP_NOT:
-		offset = chunk.printSimpleInstruction("OP_NOT", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_NOT", offset)
 	case OP_NEGATE:
-		offset = chunk.printSimpleInstruction("OP_NEGATE", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_NEGATE", offset)
+	case OP_PRINT:
+		offset = chunk.printSimpleInstruction(w, "OP_PRINT", offset)
+	case OP_JUMP:
+		offset = chunk.printJumpInstruction(w, "OP_JUMP", 1, offset)
+	case OP_JUMP_IF_FALSE:
+		offset = chunk.printJumpInstruction(w, "OP_JUMP_IF_FALSE", 1, offset)
+	case OP_LOOP:
+		offset = chunk.printJumpInstruction(w, "OP_LOOP", -1, offset)
+	case OP_CALL:
+		offset = chunk.printByteInstruction(w, "OP_CALL", offset)
+	case OP_CLOSURE:
+		offset = chunk.printClosureInstruction(w, "OP_CLOSURE", offset)
+	case OP_CLOSE_UPVALUE:
+		offset = chunk.printSimpleInstruction(w, "OP_CLOSE_UPVALUE", offset)
+	case OP_CLASS:
+		offset = chunk.printConstantInstruction(w, "OP_CLASS", offset)
+	case OP_METHOD:
+		offset = chunk.printConstantInstruction(w, "OP_METHOD", offset)
+	case OP_INVOKE:
+		offset = chunk.printInvokeInstruction(w, "OP_INVOKE", offset)
+	case OP_SUPER_INVOKE:
+		offset = chunk.printInvokeInstruction(w, "OP_SUPER_INVOKE", offset)
+	case OP_INHERIT:
+		offset = chunk.printSimpleInstruction(w, "OP_INHERIT", offset)
 	case OP_RETURN:
-		offset = chunk.printSimpleInstruction("OP_RETURN", offset)
+		offset = chunk.printSimpleInstruction(w, "OP_RETURN", offset)
 	default:
-		fmt.Printf("Unknown opcode %d\n", c)
+		fmt.Fprintf(w, "Unknown opcode %d\n", c)
 		offset += 1
 	}
 	return offset
 }
 
-func (chunk *Chunk) Disassemble(name string) {
-	fmt.Printf("== %s ==\n", name)
+func (chunk *Chunk) Disassemble(w io.Writer, name string) {
+	fmt.Fprintf(w, "== %s ==\n", name)
 	for offset := 0; offset < len(chunk.Code); {
-		offset = chunk.DisassembleInstruction(offset)
+		offset = chunk.DisassembleInstruction(w, offset)
 	}
 
 }
@@ -120,7 +243,36 @@ func (chunk *Chunk) AddConstant(x Value) uint8 {
 	return uint8(len(chunk.Constants)) - 1
 }
 
-func ParseByteCode(r io.Reader) (Chunk, error) {
+// Assembler instructions that take a single byte operand,
+// either a constant index or a stack slot.
+var operandInstructions = map[string]OpCode{
+	"constant":      OP_CONSTANT,
+	"get_local":     OP_GET_LOCAL,
+	"set_local":     OP_SET_LOCAL,
+	"call":          OP_CALL,
+	"get_global":    OP_GET_GLOBAL,
+	"define_global": OP_DEFINE_GLOBAL,
+	"set_global":    OP_SET_GLOBAL,
+	"get_upvalue":   OP_GET_UPVALUE,
+	"set_upvalue":   OP_SET_UPVALUE,
+	"get_property":  OP_GET_PROPERTY,
+	"set_property":  OP_SET_PROPERTY,
+	"class":         OP_CLASS,
+	"method":        OP_METHOD,
+	"get_super":     OP_GET_SUPER,
+}
+
+// Assembler instructions that take a 16-bit jump offset as operand.
+var jumpInstructions = map[string]OpCode{
+	"jump":          OP_JUMP,
+	"jump_if_false": OP_JUMP_IF_FALSE,
+	"loop":          OP_LOOP,
+}
+
+// Parse a textual bytecode file. The .data section holds one constant per line,
+// either a number or a double quoted string. The .text section holds one instruction per line.
+// String constants are allocated on the given heap.
+func ParseByteCode(r io.Reader, heap *Heap) (Chunk, error) {
 	chunk := MakeChunk()
 	scanner := bufio.NewScanner(r)
 	section := ""
@@ -138,36 +290,82 @@ func ParseByteCode(r io.Reader) (Chunk, error) {
 
 		switch section {
 		case "data":
+			if strings.HasPrefix(line, "\"") {
+				s, err := strconv.Unquote(line)
+				if err != nil {
+					return chunk, err
+				}
+				chunk.Constants = append(chunk.Constants, NewObjString(heap, []byte(s)))
+				continue
+			}
 			num, err := strconv.ParseFloat(line, 64)
 			if err != nil {
 				return chunk, err
 			}
 			chunk.Constants = append(chunk.Constants, NewNumber(Number(num)))
 		case "text":
+			pos := Position{Line: lineNumber}
 			parts := strings.Split(line, " ")
-			switch parts[0] {
-			case "constant":
+			if op, ok := operandInstructions[parts[0]]; ok {
 				if len(parts) != 2 {
-					return chunk, fmt.Errorf("wrong number of arguments for constant instruction, expected %d, got %d", 1, len(parts)-1)
+					return chunk, fmt.Errorf("wrong number of arguments for %s instruction, expected %d, got %d", parts[0], 1, len(parts)-1)
 				}
-				chunk.Write(uint8(OP_CONSTANT), lineNumber)
+				chunk.Write(uint8(op), pos)
 				c, err := strconv.ParseUint(parts[1], 10, 8)
 				if err != nil {
 					return chunk, err
 				}
-				chunk.Write(uint8(c), lineNumber)
+				chunk.Write(uint8(c), pos)
+				continue
+			}
+			if op, ok := jumpInstructions[parts[0]]; ok {
+				if len(parts) != 2 {
+					return chunk, fmt.Errorf("wrong number of arguments for %s instruction, expected %d, got %d", parts[0], 1, len(parts)-1)
+				}
+				chunk.Write(uint8(op), pos)
+				j, err := strconv.ParseUint(parts[1], 10, 16)
+				if err != nil {
+					return chunk, err
+				}
+				chunk.Write(uint8(j>>8), pos)
+				chunk.Write(uint8(j), pos)
+				continue
+			}
+			switch parts[0] {
+			case "nil":
+				chunk.Write(uint8(OP_NIL), pos)
+			case "true":
+				chunk.Write(uint8(OP_TRUE), pos)
+			case "false":
+				chunk.Write(uint8(OP_FALSE), pos)
+			case "equal":
+				chunk.Write(uint8(OP_EQUAL), pos)
+			case "greater":
+				chunk.Write(uint8(OP_GREATER), pos)
+			case "less":
+				chunk.Write(uint8(OP_LESS), pos)
+			case "not":
+				chunk.Write(uint8(OP_NOT), pos)
 			case "add":
-				chunk.Write(uint8(OP_ADD), lineNumber)
+				chunk.Write(uint8(OP_ADD), pos)
 			case "subtract":
-				chunk.Write(uint8(OP_SUBTRACT), lineNumber)
+				chunk.Write(uint8(OP_SUBTRACT), pos)
 			case "multiply":
-				chunk.Write(uint8(OP_MULTIPLY), lineNumber)
+				chunk.Write(uint8(OP_MULTIPLY), pos)
 			case "divide":
-				chunk.Write(uint8(OP_DIVIDE), lineNumber)
+				chunk.Write(uint8(OP_DIVIDE), pos)
 			case "negate":
-				chunk.Write(uint8(OP_NEGATE), lineNumber)
+				chunk.Write(uint8(OP_NEGATE), pos)
+			case "pop":
+				chunk.Write(uint8(OP_POP), pos)
+			case "close_upvalue":
+				chunk.Write(uint8(OP_CLOSE_UPVALUE), pos)
+			case "inherit":
+				chunk.Write(uint8(OP_INHERIT), pos)
+			case "print":
+				chunk.Write(uint8(OP_PRINT), pos)
 			case "return":
-				chunk.Write(uint8(OP_RETURN), lineNumber)
+				chunk.Write(uint8(OP_RETURN), pos)
 			default:
 				return chunk, fmt.Errorf("unknown instruction %s", line)
 			}
@@ -0,0 +1,383 @@
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// UnsupportedTypeError is returned when a Go type has no Lox equivalent.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("unsupported Go type %s", e.Type)
+}
+
+// FromGo converts nil, booleans, numbers, strings, structs, maps with string
+// keys and pointers to them into a Value, the inverse of Decode. Structs and
+// maps become instances of a class named after their Go type, their fields
+// are named like Decode matches them. Values and objects are returned as they
+// are. Lox has no list type, so slices, arrays and other types are reported
+// as an *UnsupportedTypeError.
+//
+// The conversion takes the heap of the VM that uses the value, objects are
+// allocated there. Strings are interned there too, so they work as table
+// keys. glox.Interpreter.FromGo converts with the heap of the interpreter.
+func FromGo(heap *Heap, x any) (Value, error) {
+	c := converter{
+		heap:    heap,
+		classes: map[reflect.Type]*ObjClass{},
+		seen:    map[pointerKey]*ObjInstance{},
+	}
+	return c.fromGo(x)
+}
+
+type converter struct {
+	heap    *Heap
+	classes map[reflect.Type]*ObjClass // one class per Go type
+	seen    map[pointerKey]*ObjInstance
+}
+
+// A struct or map already converted is remembered by its address, so cycles
+// between them become cycles between instances.
+type pointerKey struct {
+	p uintptr
+	t reflect.Type
+}
+
+func (c *converter) fromGo(x any) (Value, error) {
+	switch x := x.(type) {
+	case nil:
+		return NewNil(), nil
+	case Value:
+		return x, nil
+	case Object:
+		return NewObj(x), nil
+	}
+	return c.fromReflect(reflect.ValueOf(x))
+}
+
+func (c *converter) fromReflect(rv reflect.Value) (Value, error) {
+	switch rv.Kind() {
+	case reflect.Bool:
+		return NewBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewNumber(Number(rv.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NewNumber(Number(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return NewNumber(Number(rv.Float())), nil
+	case reflect.String:
+		return NewObjString(c.heap, []byte(rv.String())), nil
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return NewNil(), nil
+		}
+		if rv.Elem().Kind() == reflect.Struct {
+			key := pointerKey{rv.Pointer(), rv.Type()}
+			if instance, ok := c.seen[key]; ok {
+				return NewObj(instance), nil
+			}
+			return c.fromStruct(rv.Elem(), key)
+		}
+		return c.fromGo(rv.Elem().Interface())
+	case reflect.Interface:
+		if rv.IsNil() {
+			return NewNil(), nil
+		}
+		return c.fromGo(rv.Elem().Interface())
+	case reflect.Struct:
+		return c.fromStruct(rv, pointerKey{})
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			return NewNil(), nil
+		}
+		key := pointerKey{rv.Pointer(), rv.Type()}
+		if instance, ok := c.seen[key]; ok {
+			return NewObj(instance), nil
+		}
+		return c.fromMap(rv, key)
+	}
+	return NewNil(), &UnsupportedTypeError{Type: rv.Type()}
+}
+
+func (c *converter) newInstance(t reflect.Type, key pointerKey) *ObjInstance {
+	class, ok := c.classes[t]
+	if !ok {
+		name := t.Name()
+		if name == "" {
+			name = "Object"
+		}
+		class = NewClass(c.heap, CopyString(c.heap, []byte(name)))
+		c.classes[t] = class
+	}
+	instance := NewInstance(c.heap, class)
+	if key != (pointerKey{}) {
+		c.seen[key] = instance
+	}
+	return instance
+}
+
+// Fields are named and skipped like in decodeStruct.
+func (c *converter) fromStruct(rv reflect.Value, key pointerKey) (Value, error) {
+	t := rv.Type()
+	instance := c.newInstance(t, key)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("lox"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+
+		value, err := c.fromReflect(rv.Field(i))
+		if err != nil {
+			return NewNil(), fmt.Errorf("field %s: %w", name, err)
+		}
+		instance.Fields.Set(CopyString(c.heap, []byte(name)), value)
+	}
+	return NewObj(instance), nil
+}
+
+func (c *converter) fromMap(rv reflect.Value, key pointerKey) (Value, error) {
+	instance := c.newInstance(rv.Type(), key)
+	iter := rv.MapRange()
+	for iter.Next() {
+		name := iter.Key().String()
+		value, err := c.fromReflect(iter.Value())
+		if err != nil {
+			return NewNil(), fmt.Errorf("field %s: %w", name, err)
+		}
+		instance.Fields.Set(CopyString(c.heap, []byte(name)), value)
+	}
+	return NewObj(instance), nil
+}
+
+// ToGo converts the value to nil, bool, float64 or string. An instance
+// becomes a map[string]any of its fields. Other objects, like functions and
+// classes, have no Go equivalent and are returned as the Object itself.
+func (v Value) ToGo() any {
+	return toGo(v, map[*ObjInstance]map[string]any{})
+}
+
+// Instances already converted are remembered, so cycles between instances
+// become cycles between maps.
+func toGo(v Value, seen map[*ObjInstance]map[string]any) any {
+	switch v.Kind() {
+	case VAL_NIL:
+		return nil
+	case VAL_BOOL:
+		return v.AsBool()
+	case VAL_NUMBER:
+		return float64(v.AsNumber())
+	}
+
+	switch o := v.AsObject().(type) {
+	case *ObjString:
+		return string(o.Bytes)
+	case *ObjInstance:
+		if fields, ok := seen[o]; ok {
+			return fields
+		}
+		fields := map[string]any{}
+		seen[o] = fields
+		for _, entry := range o.Fields.entries {
+			if entry.key != nil {
+				fields[string(entry.key.Bytes)] = toGo(entry.value, seen)
+			}
+		}
+		return fields
+	default:
+		return o
+	}
+}
+
+// Decode stores the value in the Go value target points to, converting it
+// like ToGo but to the target's type. Numbers decode into any integer or
+// float type if they fit, instances decode into structs and maps with string
+// keys. Struct fields are matched by name, or by the name in a `lox` tag;
+// the tag "-" skips a field. An instance that is reached again through a
+// pointer decodes into the same pointer, so cycles are kept.
+func Decode(v Value, target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("decode target must be a non-nil pointer")
+	}
+	return decode(v, rv.Elem(), map[decodedKey]reflect.Value{})
+}
+
+// The pointer an instance was decoded into, by pointer type.
+type decodedKey struct {
+	instance *ObjInstance
+	t        reflect.Type
+}
+
+var valueType = reflect.TypeFor[Value]()
+
+func decode(v Value, rv reflect.Value, seen map[decodedKey]reflect.Value) error {
+	if rv.Type() == valueType {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			rv.SetZero()
+			return nil
+		}
+		if rv.NumMethod() != 0 {
+			// For example Object, or an interface of a single object type.
+			if o, err := v.Object(); err == nil && reflect.TypeOf(o).Implements(rv.Type()) {
+				rv.Set(reflect.ValueOf(o))
+				return nil
+			}
+			break
+		}
+		rv.Set(reflect.ValueOf(v.ToGo()))
+		return nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			rv.SetZero()
+			return nil
+		}
+		if v.IsInstance() {
+			key := decodedKey{v.AsInstance(), rv.Type()}
+			if p, ok := seen[key]; ok {
+				rv.Set(p)
+				return nil
+			}
+			if rv.IsNil() {
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			seen[key] = rv
+		} else if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return decode(v, rv.Elem(), seen)
+	case reflect.Bool:
+		b, err := v.Bool()
+		if err != nil {
+			return err
+		}
+		rv.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := decodeInteger(v, rv.Type())
+		if err != nil {
+			return err
+		}
+		if n < math.MinInt64 || n >= math.MaxInt64 || rv.OverflowInt(int64(n)) {
+			return fmt.Errorf("number %g overflows %s", n, rv.Type())
+		}
+		rv.SetInt(int64(n))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := decodeInteger(v, rv.Type())
+		if err != nil {
+			return err
+		}
+		if n < 0 || n >= math.MaxUint64 || rv.OverflowUint(uint64(n)) {
+			return fmt.Errorf("number %g overflows %s", n, rv.Type())
+		}
+		rv.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		n, err := v.Number()
+		if err != nil {
+			return err
+		}
+		rv.SetFloat(float64(n))
+		return nil
+	case reflect.String:
+		s, err := Cast[*ObjString](v)
+		if err != nil {
+			return err
+		}
+		rv.SetString(string(s.Bytes))
+		return nil
+	case reflect.Struct:
+		instance, err := Cast[*ObjInstance](v)
+		if err != nil {
+			return err
+		}
+		return decodeStruct(instance, rv, seen)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		instance, err := Cast[*ObjInstance](v)
+		if err != nil {
+			return err
+		}
+		return decodeMap(instance, rv, seen)
+	}
+	return &UnsupportedTypeError{Type: rv.Type()}
+}
+
+func decodeInteger(v Value, t reflect.Type) (float64, error) {
+	n, err := v.Number()
+	if err != nil {
+		return 0, err
+	}
+	if math.Trunc(float64(n)) != float64(n) {
+		return 0, fmt.Errorf("number %g is not an integer, cannot decode into %s", n, t)
+	}
+	return float64(n), nil
+}
+
+// Fields missing from the instance keep their value.
+func decodeStruct(instance *ObjInstance, rv reflect.Value, seen map[decodedKey]reflect.Value) error {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("lox"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+
+		value, ok := instance.Fields.GetString(name)
+		if !ok {
+			continue
+		}
+		if err := decode(value, rv.Field(i), seen); err != nil {
+			return fmt.Errorf("field %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func decodeMap(instance *ObjInstance, rv reflect.Value, seen map[decodedKey]reflect.Value) error {
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMap(rv.Type()))
+	}
+	elemType := rv.Type().Elem()
+	for _, entry := range instance.Fields.entries {
+		if entry.key == nil {
+			continue
+		}
+		elem := reflect.New(elemType).Elem()
+		if err := decode(entry.value, elem, seen); err != nil {
+			return fmt.Errorf("field %s: %w", entry.key.Bytes, err)
+		}
+		rv.SetMapIndex(reflect.ValueOf(string(entry.key.Bytes)).Convert(rv.Type().Key()), elem)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package chunk
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/huandu/go-assert"
+)
+
+type celsius float64
+
+func TestFromGo(t *testing.T) {
+	var heap Heap
+	s := "hello"
+	inputs := []struct {
+		x        any
+		expected Value
+	}{
+		{nil, NewNil()},
+		{true, NewBool(true)},
+		{42, NewNumber(42)},
+		{uint8(7), NewNumber(7)},
+		{float32(0.5), NewNumber(0.5)},
+		{celsius(-3.5), NewNumber(-3.5)},
+		{"hello", NewObjString(&heap, []byte("hello"))},
+		{&s, NewObjString(&heap, []byte("hello"))},
+		{(*int)(nil), NewNil()},
+		{NewNumber(1), NewNumber(1)},
+	}
+	for _, input := range inputs {
+		v, err := FromGo(&heap, input.x)
+		assert.Assert(t, err == nil)
+		assert.Assert(t, ValuesEqual(v, input.expected))
+	}
+
+	// Strings are interned and accounted for.
+	before := heap.BytesAllocated()
+	v, err := FromGo(&heap, "a new string")
+	assert.Assert(t, err == nil)
+	assert.Assert(t, v.AsString() == CopyString(&heap, []byte("a new string")))
+	assert.Assert(t, heap.BytesAllocated() > before)
+
+	class := NewClass(&heap, CopyString(&heap, []byte("A")))
+	v, err = FromGo(&heap, class)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, v.AsClass() == class)
+}
+
+func TestFromGoUnsupported(t *testing.T) {
+	var heap Heap
+	// Lox has no list type for slices.
+	for _, x := range []any{[]int{1}, map[int]string{}, struct{ C chan int }{}, make(chan int)} {
+		_, err := FromGo(&heap, x)
+		var unsupported *UnsupportedTypeError
+		assert.Assert(t, errors.As(err, &unsupported))
+		if _, ok := x.(struct{ C chan int }); ok {
+			continue // reported for the field
+		}
+		assert.AssertEqual(t, unsupported.Type, reflect.TypeOf(x))
+	}
+}
+
+type Location struct {
+	Name     string  `lox:"name"`
+	Lat, Lon float64 // named as the Go fields
+	Hidden   int     `lox:"-"`
+	Tags     map[string]string
+	Next     *Location `lox:"next"`
+	private  int
+}
+
+// Structs and maps become instances, Decode turns them back.
+func TestFromGoInstances(t *testing.T) {
+	var heap Heap
+	home := &Location{Name: "home", Lat: 52.1, Lon: 5.1, Hidden: 1, Tags: map[string]string{"kind": "house"}, private: 2}
+	home.Next = home
+
+	v, err := FromGo(&heap, home)
+	assert.Assert(t, err == nil)
+	instance := v.AsInstance()
+	assert.AssertEqual(t, string(instance.Class.Name.Bytes), "Location")
+	assert.AssertEqual(t, instance.Fields.count, 5)
+	next, _ := instance.Fields.GetString("next")
+	assert.Assert(t, next.AsInstance() == instance)
+	tags, _ := instance.Fields.GetString("Tags")
+	assert.AssertEqual(t, string(tags.AsInstance().Class.Name.Bytes), "Object")
+
+	var decoded Location
+	assert.Assert(t, Decode(v, &decoded) == nil)
+	assert.AssertEqual(t, decoded.Name, "home")
+	assert.AssertEqual(t, decoded.Lon, 5.1)
+	assert.AssertEqual(t, decoded.Hidden, 0)
+	assert.AssertEqual(t, decoded.Tags, map[string]string{"kind": "house"})
+	assert.AssertEqual(t, decoded.Next.Name, "home")
+	assert.Assert(t, decoded.Next.Next == decoded.Next)
+
+	v, err = FromGo(&heap, map[string]any{"n": 1, "nested": struct{ S string }{"s"}})
+	assert.Assert(t, err == nil)
+	assert.AssertEqual(t, v.ToGo(), map[string]any{"n": 1.0, "nested": map[string]any{"S": "s"}})
+}
+
+// An instance of class Point with the fields x, y and label.
+func makePoint(heap *Heap) *ObjInstance {
+	point := NewInstance(heap, NewClass(heap, CopyString(heap, []byte("Point"))))
+	point.Fields.Set(CopyString(heap, []byte("x")), NewNumber(1))
+	point.Fields.Set(CopyString(heap, []byte("y")), NewNumber(2.5))
+	point.Fields.Set(CopyString(heap, []byte("label")), NewObjString(heap, []byte("origin")))
+	return point
+}
+
+func TestToGo(t *testing.T) {
+	var heap Heap
+	assert.AssertEqual(t, NewNil().ToGo(), nil)
+	assert.AssertEqual(t, NewBool(true).ToGo(), true)
+	assert.AssertEqual(t, NewNumber(1.5).ToGo(), 1.5)
+	assert.AssertEqual(t, NewObjString(&heap, []byte("hi")).ToGo(), "hi")
+
+	point := makePoint(&heap)
+	assert.AssertEqual(t, NewObj(point).ToGo(), map[string]any{"x": 1.0, "y": 2.5, "label": "origin"})
+
+	// Cycles become cycles between maps.
+	point.Fields.Set(CopyString(&heap, []byte("self")), NewObj(point))
+	fields := NewObj(point).ToGo().(map[string]any)
+	assert.Assert(t, reflect.ValueOf(fields["self"]).Pointer() == reflect.ValueOf(fields).Pointer())
+
+	function := NewFunction(&heap)
+	assert.Assert(t, NewObj(function).ToGo() == Object(function))
+}
+
+func TestDecode(t *testing.T) {
+	var heap Heap
+	var b bool
+	assert.Assert(t, Decode(NewBool(true), &b) == nil)
+	assert.Assert(t, b)
+
+	var i int8
+	assert.Assert(t, Decode(NewNumber(-5), &i) == nil)
+	assert.AssertEqual(t, i, int8(-5))
+
+	var f celsius
+	assert.Assert(t, Decode(NewNumber(21.5), &f) == nil)
+	assert.AssertEqual(t, f, celsius(21.5))
+
+	var s *string
+	assert.Assert(t, Decode(NewObjString(&heap, []byte("hello")), &s) == nil)
+	assert.AssertEqual(t, *s, "hello")
+	assert.Assert(t, Decode(NewNil(), &s) == nil)
+	assert.Assert(t, s == nil)
+
+	var x any
+	assert.Assert(t, Decode(NewNumber(3), &x) == nil)
+	assert.AssertEqual(t, x, 3.0)
+
+	var value Value
+	assert.Assert(t, Decode(NewNumber(3), &value) == nil)
+	assert.Assert(t, ValuesEqual(value, NewNumber(3)))
+
+	var object Object
+	function := NewFunction(&heap)
+	assert.Assert(t, Decode(NewObj(function), &object) == nil)
+	assert.Assert(t, object == Object(function))
+	assert.Assert(t, Decode(NewNil(), &object) == nil)
+	assert.Assert(t, object == nil)
+
+	type Point struct {
+		X       float64 `lox:"x"`
+		Y       int     `lox:"y"`
+		Label   string  `lox:"label"`
+		Skipped string  `lox:"-"`
+		Missing string
+	}
+	point := Point{Missing: "kept"}
+	err := Decode(NewObj(makePoint(&heap)), &point)
+	assert.Assert(t, err != nil) // y is 2.5, not an integer
+
+	instance := makePoint(&heap)
+	instance.Fields.Set(CopyString(&heap, []byte("y")), NewNumber(2))
+	instance.Fields.Set(CopyString(&heap, []byte("Skipped")), NewNumber(0))
+	assert.Assert(t, Decode(NewObj(instance), &point) == nil)
+	assert.AssertEqual(t, point, Point{X: 1, Y: 2, Label: "origin", Missing: "kept"})
+
+	var m map[string]any
+	assert.Assert(t, Decode(NewObj(makePoint(&heap)), &m) == nil)
+	assert.AssertEqual(t, m, map[string]any{"x": 1.0, "y": 2.5, "label": "origin"})
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var heap Heap
+	var n int
+	var u uint8
+	var s string
+	var list []int
+	var point struct{ X int }
+
+	assert.Assert(t, Decode(NewNumber(1), n) != nil)
+	assert.Assert(t, Decode(NewNumber(1), (*int)(nil)) != nil)
+	assert.Assert(t, Decode(NewNumber(1.5), &n) != nil)
+	assert.Assert(t, Decode(NewNumber(256), &u) != nil)
+	assert.Assert(t, Decode(NewNumber(-1), &u) != nil)
+	assert.Assert(t, Decode(NewNumber(Number(math.Inf(1))), &n) != nil)
+
+	var typeErr *TypeError
+	assert.Assert(t, errors.As(Decode(NewNumber(1), &s), &typeErr))
+	assert.AssertEqual(t, *typeErr, TypeError{Expected: "string", Actual: "number"})
+	assert.Assert(t, errors.As(Decode(NewObjString(&heap, []byte("1")), &point), &typeErr))
+
+	var unsupported *UnsupportedTypeError
+	assert.Assert(t, errors.As(Decode(NewNil(), &list), &unsupported))
+}
@@ -0,0 +1,215 @@
+package chunk
+
+// Collect for the first time once this many bytes are allocated. After each
+// collection the threshold is the surviving size times the grow factor.
+const GC_INITIAL_THRESHOLD = 1024 * 1024
+const GC_HEAP_GROW_FACTOR = 2
+
+// Heap keeps account of every object allocated for a VM, so the memory a
+// script uses can be observed and bounded. Go frees the memory itself, the
+// collector only finds the objects that can no longer be reached and drops
+// the heap's references to them, which lets Go reclaim them.
+//
+// The zero Heap is empty and ready to use. It is not safe for concurrent use.
+type Heap struct {
+	strings        Table // intern table, every live string object is in here
+	objects        *Obj  // all objects, linked through Obj.next
+	objectCount    int
+	bytesAllocated int
+	nextGC         int // 0 until the first collection, see threshold
+	collections    int
+	gray           []Object            // marked objects whose references are not marked yet
+	pinned         map[Object]int      // roots held by Go code, with the number of pins
+	pinnedChunks   map[*Chunk]struct{} // compiled chunks that have not been discarded
+
+	// When positive, the VM raises an out of memory error if the heap is
+	// still larger than this after a collection.
+	MaxBytes int
+}
+
+type HeapStats struct {
+	BytesAllocated int // estimated size of all tracked objects
+	Objects        int
+	NextGC         int // collect when BytesAllocated grows past this
+	Collections    int
+}
+
+func (h *Heap) Stats() HeapStats {
+	return HeapStats{
+		BytesAllocated: h.bytesAllocated,
+		Objects:        h.objectCount,
+		NextGC:         h.threshold(),
+		Collections:    h.collections,
+	}
+}
+
+func (h *Heap) BytesAllocated() int {
+	return h.bytesAllocated
+}
+
+// Strings is the intern table. Its entries are weak: collecting removes
+// strings that are not reachable from anywhere else.
+func (h *Heap) Strings() *Table {
+	return &h.strings
+}
+
+func (h *Heap) threshold() int {
+	if h.nextGC == 0 {
+		return GC_INITIAL_THRESHOLD
+	}
+	return h.nextGC
+}
+
+// ShouldCollect reports whether the heap grew past the collection threshold
+// or the memory limit.
+func (h *Heap) ShouldCollect() bool {
+	return h.bytesAllocated > h.threshold() ||
+		h.MaxBytes > 0 && h.bytesAllocated > h.MaxBytes
+}
+
+// Link a newly created object into the heap. size is an estimate of the
+// memory the object owns, including its backing arrays.
+func (h *Heap) track(o Object, size int) {
+	header := o.header()
+	header.size = size
+	header.next = h.objects
+	h.objects = header
+	h.objectCount++
+	h.bytesAllocated += size
+}
+
+// Pin makes the object of v a root, so it survives collections while Go
+// code holds it outside of the VM and its strings stay interned. Each Pin
+// is undone by one Unpin. Values that are not objects are ignored.
+func (h *Heap) Pin(v Value) {
+	if !v.IsObj() {
+		return
+	}
+	if h.pinned == nil {
+		h.pinned = make(map[Object]int)
+	}
+	h.pinned[v.obj.self]++
+}
+
+func (h *Heap) Unpin(v Value) {
+	if !v.IsObj() {
+		return
+	}
+	o := v.obj.self
+	if h.pinned[o] <= 1 {
+		delete(h.pinned, o)
+		return
+	}
+	h.pinned[o]--
+}
+
+// PinChunk makes the constants of a chunk compiled for this heap roots, so
+// the names it refers to stay interned until the chunk is run. Unlike Pin it
+// is not counted, the chunk stays pinned until UnpinChunk.
+func (h *Heap) PinChunk(c *Chunk) {
+	if h.pinnedChunks == nil {
+		h.pinnedChunks = make(map[*Chunk]struct{})
+	}
+	h.pinnedChunks[c] = struct{}{}
+}
+
+func (h *Heap) UnpinChunk(c *Chunk) {
+	delete(h.pinnedChunks, c)
+}
+
+// A collection starts with the owner of the heap marking its roots with
+// MarkValue, MarkObject and MarkTable, then calling Collect. Pinned objects
+// and chunks are marked by Collect itself.
+
+func (h *Heap) MarkObject(o Object) {
+	header := o.header()
+	if header.isMarked {
+		return
+	}
+	header.isMarked = true
+	h.gray = append(h.gray, o)
+}
+
+func (h *Heap) MarkValue(v Value) {
+	if v.IsObj() {
+		h.MarkObject(v.obj.self)
+	}
+}
+
+func (h *Heap) MarkTable(t *Table) {
+	for i := range t.entries {
+		entry := &t.entries[i]
+		if entry.key != nil {
+			h.MarkObject(entry.key)
+		}
+		h.MarkValue(entry.value)
+	}
+}
+
+// Collect traces everything reachable from the marked roots and drops all
+// other objects from the heap.
+func (h *Heap) Collect() {
+	h.markPinned()
+	h.traceReferences()
+	h.removeWhiteStrings()
+	h.sweep()
+
+	h.nextGC = max(h.bytesAllocated*GC_HEAP_GROW_FACTOR, GC_INITIAL_THRESHOLD)
+	h.collections++
+}
+
+func (h *Heap) markPinned() {
+	for o := range h.pinned {
+		h.MarkObject(o)
+	}
+	for c := range h.pinnedChunks {
+		for _, constant := range c.Constants {
+			h.MarkValue(constant)
+		}
+	}
+}
+
+func (h *Heap) traceReferences() {
+	for len(h.gray) > 0 {
+		o := h.gray[len(h.gray)-1]
+		h.gray = h.gray[:len(h.gray)-1]
+		o.blacken(h)
+	}
+	// Do not keep the last batch of objects alive through the backing array.
+	h.gray = h.gray[:0:0]
+}
+
+// The intern table does not keep strings alive, remove the unmarked ones
+// before they are swept.
+func (h *Heap) removeWhiteStrings() {
+	for i := range h.strings.entries {
+		key := h.strings.entries[i].key
+		if key != nil && !key.isMarked {
+			h.strings.Delete(key)
+		}
+	}
+}
+
+func (h *Heap) sweep() {
+	var previous *Obj
+	object := h.objects
+	for object != nil {
+		if object.isMarked {
+			object.isMarked = false
+			previous = object
+			object = object.next
+			continue
+		}
+
+		unreached := object
+		object = object.next
+		if previous != nil {
+			previous.next = object
+		} else {
+			h.objects = object
+		}
+		unreached.next = nil
+		h.objectCount--
+		h.bytesAllocated -= unreached.size
+	}
+}
@@ -0,0 +1,101 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/huandu/go-assert"
+)
+
+func TestHeapTracksObjects(t *testing.T) {
+	var heap Heap
+	s := CopyString(&heap, []byte("hello"))
+	assert.AssertEqual(t, heap.Stats().Objects, 1)
+	assert.Assert(t, heap.BytesAllocated() >= len("hello"))
+
+	// Interned strings are not allocated twice.
+	assert.Assert(t, CopyString(&heap, []byte("hello")) == s)
+	assert.AssertEqual(t, heap.Stats().Objects, 1)
+
+	NewClosure(&heap, NewFunction(&heap))
+	assert.AssertEqual(t, heap.Stats().Objects, 3)
+}
+
+func TestHeapCollect(t *testing.T) {
+	var heap Heap
+	name := CopyString(&heap, []byte("Pair"))
+	class := NewClass(&heap, name)
+	instance := NewInstance(&heap, class)
+	instance.Fields.Set(CopyString(&heap, []byte("first")), NewObjString(&heap, []byte("kept")))
+	CopyString(&heap, []byte("garbage"))
+	NewFunction(&heap)
+	assert.AssertEqual(t, heap.Stats().Objects, 7)
+
+	heap.MarkObject(instance)
+	heap.Collect()
+
+	stats := heap.Stats()
+	assert.AssertEqual(t, stats.Objects, 5)
+	assert.AssertEqual(t, stats.Collections, 1)
+	// Unreachable strings are removed from the intern table.
+	assert.Assert(t, heap.Strings().FindString([]byte("garbage"), hashString([]byte("garbage"))) == nil)
+	assert.Assert(t, heap.Strings().FindString([]byte("kept"), hashString([]byte("kept"))) != nil)
+
+	// Marks are cleared, without roots everything goes.
+	heap.Collect()
+	assert.AssertEqual(t, heap.Stats().Objects, 0)
+	assert.AssertEqual(t, heap.BytesAllocated(), 0)
+}
+
+func TestHeapCollectClosures(t *testing.T) {
+	var heap Heap
+	function := NewFunction(&heap)
+	function.Name = CopyString(&heap, []byte("f"))
+	function.Chunk.AddConstant(NewObjString(&heap, []byte("constant")))
+	function.UpvalueCount = 1
+	closure := NewClosure(&heap, function)
+	upvalue := NewUpvalue(&heap, 0)
+	upvalue.Close(NewObjString(&heap, []byte("captured")))
+	closure.Upvalues[0] = upvalue
+	bound := NewBoundMethod(&heap, NewNil(), closure)
+	assert.AssertEqual(t, heap.Stats().Objects, 7)
+
+	heap.MarkObject(bound)
+	heap.Collect()
+	assert.AssertEqual(t, heap.Stats().Objects, 7)
+}
+
+func TestHeapPin(t *testing.T) {
+	var heap Heap
+	instance := NewObjInstance(NewInstance(&heap, NewClass(&heap, CopyString(&heap, []byte("P")))))
+	instance.AsInstance().Fields.Set(CopyString(&heap, []byte("field")), NewNumber(1))
+	heap.Pin(instance)
+	heap.Pin(instance)
+	heap.Pin(NewNumber(2))
+
+	heap.Collect()
+	assert.AssertEqual(t, heap.Stats().Objects, 4)
+	assert.Assert(t, heap.Strings().FindString([]byte("field"), hashString([]byte("field"))) != nil)
+
+	// Pins are counted.
+	heap.Unpin(instance)
+	heap.Collect()
+	assert.AssertEqual(t, heap.Stats().Objects, 4)
+	heap.Unpin(instance)
+	heap.Collect()
+	assert.AssertEqual(t, heap.Stats().Objects, 0)
+}
+
+func TestHeapPinChunk(t *testing.T) {
+	var heap Heap
+	c := MakeChunk()
+	c.AddConstant(NewObjString(&heap, []byte("name")))
+	heap.PinChunk(&c)
+	heap.PinChunk(&c)
+
+	heap.Collect()
+	assert.AssertEqual(t, heap.Stats().Objects, 1)
+
+	heap.UnpinChunk(&c)
+	heap.Collect()
+	assert.AssertEqual(t, heap.Stats().Objects, 0)
+}
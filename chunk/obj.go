@@ -1,37 +1,362 @@
 package chunk
 
+import (
+	"fmt"
+	"io"
+	"unsafe"
+)
+
 type ObjKind byte
 
 const (
 	OBJ_STRING ObjKind = iota
+	OBJ_FUNCTION
+	OBJ_CLOSURE
+	OBJ_UPVALUE
+	OBJ_CLASS
+	OBJ_INSTANCE
+	OBJ_BOUND_METHOD
+	OBJ_NATIVE
 )
 
+// Object is implemented by every kind of heap allocated Lox value.
+// Object types embed Obj, which provides Kind and default identity based
+// Equals and Hash. Each type adds its own TypeName and Print.
+type Object interface {
+	header() *Obj
+	Kind() ObjKind
+	// Name of the type for error messages. Must not use the receiver's
+	// fields, it is also called on nil pointers.
+	TypeName() string
+	Print(w io.Writer)
+	Equals(other Object) bool
+	Hash() uint32
+	// Mark the objects this one refers to, for the garbage collector.
+	blacken(h *Heap)
+}
+
+// Obj is the header shared by all objects. Values point to the header, which
+// points back to the complete object.
 type Obj struct {
-	kind ObjKind
+	kind     ObjKind
+	isMarked bool
+	size     int  // bytes accounted to the heap for this object
+	next     *Obj // next object in the heap
+	self     Object
+}
+
+func (o *Obj) header() *Obj {
+	return o
+}
+
+func (o *Obj) Kind() ObjKind {
+	return o.kind
 }
 
+// Objects are only equal to themselves, unless the object type says otherwise.
+func (o *Obj) Equals(other Object) bool {
+	return o == other.header()
+}
+
+// Hash on identity, the Go garbage collector does not move heap objects.
+func (o *Obj) Hash() uint32 {
+	address := uint64(uintptr(unsafe.Pointer(o)))
+	return uint32(address>>3) ^ uint32(address>>35)
+}
+
+// Objects without references have nothing to blacken.
+func (o *Obj) blacken(h *Heap) {}
+
 type ObjString struct {
 	Obj
 	Length int
 	Bytes  []byte
+	hash   uint32 // FNV-1a of Bytes, computed once when the string is created
+}
+
+func (s *ObjString) TypeName() string {
+	return "string"
 }
 
-func CopyString(s []byte) ObjString {
+func (s *ObjString) Print(w io.Writer) {
+	w.Write(s.Bytes)
+}
+
+func (s *ObjString) Hash() uint32 {
+	return s.hash
+}
+
+func newString(s []byte, hash uint32) *ObjString {
+	str := &ObjString{
+		Length: len(s),
+		Bytes:  s,
+		hash:   hash,
+	}
+	str.Obj = Obj{kind: OBJ_STRING, self: str}
+	return str
+}
+
+func allocateString(heap *Heap, s []byte, hash uint32) *ObjString {
+	str := newString(s, hash)
+	heap.track(str, int(unsafe.Sizeof(*str))+cap(s))
+	// The intern table is used as a set, only the keys matter.
+	heap.strings.Set(str, NewNil())
+	return str
+}
+
+// Return the interned string with the same content as s.
+// A new string copies s, so the caller can keep using it.
+func CopyString(heap *Heap, s []byte) *ObjString {
+	hash := hashString(s)
+	if interned := heap.strings.FindString(s, hash); interned != nil {
+		return interned
+	}
+
 	// TODO: or do we want null-terminated []byte arrays?
 	dest := make([]byte, len(s))
 	copy(dest, s)
-	return ObjString{
-		Obj:    Obj{kind: OBJ_STRING},
-		Length: len(dest),
-		Bytes:  dest,
+	return allocateString(heap, dest, hash)
+}
+
+// Like CopyString, but takes ownership of s instead of copying it.
+func TakeString(heap *Heap, s []byte) *ObjString {
+	hash := hashString(s)
+	if interned := heap.strings.FindString(s, hash); interned != nil {
+		return interned
 	}
+	return allocateString(heap, s, hash)
 }
 
-func TakeString(s []byte) ObjString {
-	// TODO: or do we want null-terminated []byte arrays?
-	return ObjString{
-		Obj:    Obj{kind: OBJ_STRING},
-		Length: len(s),
-		Bytes:  s,
+// A compiled function, the top-level script is a function without a name.
+type ObjFunction struct {
+	Obj
+	Arity        int
+	UpvalueCount int
+	Chunk        Chunk
+	Name         *ObjString
+}
+
+// The chunk is still empty, only the function itself is accounted for.
+func NewFunction(heap *Heap) *ObjFunction {
+	f := &ObjFunction{
+		Arity:        0,
+		UpvalueCount: 0,
+		Chunk:        MakeChunk(),
+		Name:         nil,
+	}
+	f.Obj = Obj{kind: OBJ_FUNCTION, self: f}
+	heap.track(f, int(unsafe.Sizeof(*f)))
+	return f
+}
+
+func (f *ObjFunction) blacken(h *Heap) {
+	if f.Name != nil {
+		h.MarkObject(f.Name)
+	}
+	for _, constant := range f.Chunk.Constants {
+		h.MarkValue(constant)
+	}
+}
+
+func (f *ObjFunction) TypeName() string {
+	return "function"
+}
+
+func (f *ObjFunction) Print(w io.Writer) {
+	if f.Name == nil {
+		fmt.Fprint(w, "<script>")
+		return
 	}
+	fmt.Fprintf(w, "<fn %s>", f.Name.Bytes)
+}
+
+// A variable captured by a closure. While the variable is still on the VM's
+// stack the upvalue is open and refers to its stack slot. When the variable
+// goes out of scope the value is moved into the upvalue itself.
+type ObjUpvalue struct {
+	Obj
+	Location int // stack slot of the variable, -1 once the upvalue is closed
+	Closed   Value
+	Next     *ObjUpvalue // open upvalues form a list sorted by stack slot
+}
+
+func NewUpvalue(heap *Heap, slot int) *ObjUpvalue {
+	u := &ObjUpvalue{
+		Location: slot,
+		Closed:   NewNil(),
+		Next:     nil,
+	}
+	u.Obj = Obj{kind: OBJ_UPVALUE, self: u}
+	heap.track(u, int(unsafe.Sizeof(*u)))
+	return u
+}
+
+// An open upvalue refers to a stack slot, which is a root already.
+func (u *ObjUpvalue) blacken(h *Heap) {
+	h.MarkValue(u.Closed)
+}
+
+func (u *ObjUpvalue) TypeName() string {
+	return "upvalue"
+}
+
+func (u *ObjUpvalue) Print(w io.Writer) {
+	fmt.Fprint(w, "upvalue")
+}
+
+func (u *ObjUpvalue) IsOpen() bool {
+	return u.Location != -1
+}
+
+// Move the captured value off the stack into the upvalue.
+func (u *ObjUpvalue) Close(value Value) {
+	u.Closed = value
+	u.Location = -1
+}
+
+// A function together with the variables it captured when it was created.
+type ObjClosure struct {
+	Obj
+	Function *ObjFunction
+	Upvalues []*ObjUpvalue
+}
+
+func NewClosure(heap *Heap, function *ObjFunction) *ObjClosure {
+	c := &ObjClosure{
+		Function: function,
+		Upvalues: make([]*ObjUpvalue, function.UpvalueCount),
+	}
+	c.Obj = Obj{kind: OBJ_CLOSURE, self: c}
+	heap.track(c, int(unsafe.Sizeof(*c))+function.UpvalueCount*int(unsafe.Sizeof(c.Upvalues[0])))
+	return c
+}
+
+func (c *ObjClosure) blacken(h *Heap) {
+	h.MarkObject(c.Function)
+	for _, upvalue := range c.Upvalues {
+		// Upvalues are filled in after the closure is created.
+		if upvalue != nil {
+			h.MarkObject(upvalue)
+		}
+	}
+}
+
+func (c *ObjClosure) TypeName() string {
+	return "function"
+}
+
+func (c *ObjClosure) Print(w io.Writer) {
+	c.Function.Print(w)
+}
+
+type ObjClass struct {
+	Obj
+	Name    *ObjString
+	Methods Table // closures by method name
+}
+
+func NewClass(heap *Heap, name *ObjString) *ObjClass {
+	c := &ObjClass{Name: name}
+	c.Obj = Obj{kind: OBJ_CLASS, self: c}
+	heap.track(c, int(unsafe.Sizeof(*c)))
+	return c
+}
+
+func (c *ObjClass) blacken(h *Heap) {
+	h.MarkObject(c.Name)
+	h.MarkTable(&c.Methods)
+}
+
+func (c *ObjClass) TypeName() string {
+	return "class"
+}
+
+func (c *ObjClass) Print(w io.Writer) {
+	w.Write(c.Name.Bytes)
+}
+
+type ObjInstance struct {
+	Obj
+	Class  *ObjClass
+	Fields Table
+}
+
+func NewInstance(heap *Heap, class *ObjClass) *ObjInstance {
+	i := &ObjInstance{Class: class}
+	i.Obj = Obj{kind: OBJ_INSTANCE, self: i}
+	heap.track(i, int(unsafe.Sizeof(*i)))
+	return i
+}
+
+func (i *ObjInstance) blacken(h *Heap) {
+	h.MarkObject(i.Class)
+	h.MarkTable(&i.Fields)
+}
+
+func (i *ObjInstance) TypeName() string {
+	return "instance"
+}
+
+func (i *ObjInstance) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s instance", i.Class.Name.Bytes)
+}
+
+// A method read from an instance, it remembers the instance to use as 'this'.
+type ObjBoundMethod struct {
+	Obj
+	Receiver Value
+	Method   *ObjClosure
+}
+
+func NewBoundMethod(heap *Heap, receiver Value, method *ObjClosure) *ObjBoundMethod {
+	b := &ObjBoundMethod{
+		Receiver: receiver,
+		Method:   method,
+	}
+	b.Obj = Obj{kind: OBJ_BOUND_METHOD, self: b}
+	heap.track(b, int(unsafe.Sizeof(*b)))
+	return b
+}
+
+func (b *ObjBoundMethod) blacken(h *Heap) {
+	h.MarkValue(b.Receiver)
+	h.MarkObject(b.Method)
+}
+
+func (b *ObjBoundMethod) TypeName() string {
+	return "function"
+}
+
+func (b *ObjBoundMethod) Print(w io.Writer) {
+	b.Method.Print(w)
+}
+
+// A function implemented in Go. The arguments slice aliases the VM's stack
+// and is only valid during the call.
+type NativeFn func(args []Value) (Value, error)
+
+type ObjNative struct {
+	Obj
+	Name     string
+	Arity    int // -1 accepts any number of arguments
+	Function NativeFn
+}
+
+func NewNative(heap *Heap, name string, arity int, function NativeFn) *ObjNative {
+	n := &ObjNative{
+		Name:     name,
+		Arity:    arity,
+		Function: function,
+	}
+	n.Obj = Obj{kind: OBJ_NATIVE, self: n}
+	heap.track(n, int(unsafe.Sizeof(*n))+len(name))
+	return n
+}
+
+func (n *ObjNative) TypeName() string {
+	return "function"
+}
+
+func (n *ObjNative) Print(w io.Writer) {
+	fmt.Fprint(w, "<native fn>")
 }
@@ -0,0 +1,167 @@
+package chunk
+
+import "bytes"
+
+// Grow the table when it is more than this fraction full.
+const TABLE_MAX_LOAD = 0.75
+
+type Entry struct {
+	key   *ObjString
+	value Value
+}
+
+// Table is a hash table with open addressing and linear probing, keyed by
+// interned strings. Because keys are interned they are compared by pointer.
+// The zero Table is empty and ready to use.
+type Table struct {
+	count   int // live entries plus tombstones
+	entries []Entry
+}
+
+// FNV-1a
+func hashString(s []byte) uint32 {
+	hash := uint32(2166136261)
+	for _, c := range s {
+		hash ^= uint32(c)
+		hash *= 16777619
+	}
+	return hash
+}
+
+// Return the entry for the key, or the slot where it should be inserted.
+// The capacity is a power of two, so the modulo is a mask.
+func findEntry(entries []Entry, key *ObjString) *Entry {
+	mask := uint32(len(entries) - 1)
+	index := key.hash & mask
+	var tombstone *Entry
+
+	for {
+		entry := &entries[index]
+		if entry.key == nil {
+			if entry.value.IsNil() {
+				// Empty entry, reuse a tombstone we passed if there was one.
+				if tombstone != nil {
+					return tombstone
+				}
+				return entry
+			} else if tombstone == nil {
+				tombstone = entry
+			}
+		} else if entry.key == key {
+			return entry
+		}
+		index = (index + 1) & mask
+	}
+}
+
+func (t *Table) adjustCapacity(capacity int) {
+	entries := make([]Entry, capacity)
+
+	// Reinsert the live entries, tombstones are dropped.
+	t.count = 0
+	for i := range t.entries {
+		entry := &t.entries[i]
+		if entry.key == nil {
+			continue
+		}
+		dest := findEntry(entries, entry.key)
+		dest.key = entry.key
+		dest.value = entry.value
+		t.count++
+	}
+
+	t.entries = entries
+}
+
+func (t *Table) Get(key *ObjString) (Value, bool) {
+	if t.count == 0 {
+		return NewNil(), false
+	}
+
+	entry := findEntry(t.entries, key)
+	if entry.key == nil {
+		return NewNil(), false
+	}
+	return entry.value, true
+}
+
+// Set the value for the key, returns true if the key was not in the table before.
+func (t *Table) Set(key *ObjString, value Value) bool {
+	if float64(t.count+1) > float64(len(t.entries))*TABLE_MAX_LOAD {
+		capacity := 8
+		if len(t.entries) > 0 {
+			capacity = len(t.entries) * 2
+		}
+		t.adjustCapacity(capacity)
+	}
+
+	entry := findEntry(t.entries, key)
+	isNewKey := entry.key == nil
+	// Reusing a tombstone does not change the count, it was already counted.
+	if isNewKey && entry.value.IsNil() {
+		t.count++
+	}
+
+	entry.key = key
+	entry.value = value
+	return isNewKey
+}
+
+// Remove the key, its entry becomes a tombstone so probe sequences through it stay intact.
+func (t *Table) Delete(key *ObjString) bool {
+	if t.count == 0 {
+		return false
+	}
+
+	entry := findEntry(t.entries, key)
+	if entry.key == nil {
+		return false
+	}
+
+	entry.key = nil
+	entry.value = NewBool(true)
+	return true
+}
+
+// Copy all entries of from into t.
+func (t *Table) AddAll(from *Table) {
+	for i := range from.entries {
+		entry := &from.entries[i]
+		if entry.key != nil {
+			t.Set(entry.key, entry.value)
+		}
+	}
+}
+
+// Look up a string by its content instead of by pointer, used for interning.
+func (t *Table) FindString(chars []byte, hash uint32) *ObjString {
+	if t.count == 0 {
+		return nil
+	}
+
+	mask := uint32(len(t.entries) - 1)
+	index := hash & mask
+	for {
+		entry := &t.entries[index]
+		if entry.key == nil {
+			// Stop at an empty entry, but skip over tombstones.
+			if entry.value.IsNil() {
+				return nil
+			}
+		} else if entry.key.hash == hash && bytes.Equal(entry.key.Bytes, chars) {
+			return entry.key
+		}
+		index = (index + 1) & mask
+	}
+}
+
+// Look up a key by its content, for callers that have no interned string.
+// Unlike CopyString it does not intern the name.
+func (t *Table) GetString(name string) (Value, bool) {
+	s := []byte(name)
+	key := t.FindString(s, hashString(s))
+	if key == nil {
+		return NewNil(), false
+	}
+	return t.Get(key)
+}
@@ -0,0 +1,66 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/huandu/go-assert"
+)
+
+func TestTableSetGetDelete(t *testing.T) {
+	var heap Heap
+	var table Table
+	a := CopyString(&heap, []byte("a"))
+	b := CopyString(&heap, []byte("b"))
+
+	_, ok := table.Get(a)
+	assert.Assert(t, !ok)
+
+	assert.Assert(t, table.Set(a, NewNumber(1)))
+	assert.Assert(t, !table.Set(a, NewNumber(2)))
+	value, ok := table.Get(a)
+	assert.Assert(t, ok)
+	assert.AssertEqual(t, value.AsNumber(), Number(2))
+
+	assert.Assert(t, !table.Delete(b))
+	assert.Assert(t, table.Delete(a))
+	_, ok = table.Get(a)
+	assert.Assert(t, !ok)
+	assert.Assert(t, table.Set(a, NewNumber(3)))
+}
+
+func TestTableGrow(t *testing.T) {
+	var heap Heap
+	var table Table
+	keys := make([]*ObjString, 100)
+	for i := range keys {
+		keys[i] = CopyString(&heap, []byte(fmt.Sprintf("key%d", i)))
+		table.Set(keys[i], NewNumber(Number(i)))
+	}
+	// Leave tombstones behind for every other key.
+	for i := 0; i < len(keys); i += 2 {
+		table.Delete(keys[i])
+	}
+	for i, key := range keys {
+		value, ok := table.Get(key)
+		assert.AssertEqual(t, ok, i%2 == 1)
+		if ok {
+			assert.AssertEqual(t, value.AsNumber(), Number(i))
+		}
+	}
+
+	var copied Table
+	copied.AddAll(&table)
+	value, ok := copied.Get(keys[1])
+	assert.Assert(t, ok)
+	assert.AssertEqual(t, value.AsNumber(), Number(1))
+	_, ok = copied.Get(keys[0])
+	assert.Assert(t, !ok)
+}
+
+func TestFindString(t *testing.T) {
+	var heap Heap
+	s := CopyString(&heap, []byte("hello"))
+	assert.Assert(t, heap.Strings().FindString([]byte("hello"), hashString([]byte("hello"))) == s)
+	assert.Assert(t, heap.Strings().FindString([]byte("world"), hashString([]byte("world"))) == nil)
+}
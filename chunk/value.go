@@ -1,9 +1,10 @@
 package chunk
 
 import (
-	"bytes"
 	"fmt"
-	"unsafe"
+	"io"
+	"math"
+	"os"
 )
 
 type Number float64
@@ -17,106 +18,261 @@ const (
 	VAL_OBJ
 )
 
+// A Value is two words and stores numbers, booleans and nil inline, so
+// creating one never allocates. The pointer word identifies the kind: it is
+// nil for the nil value, points to one of the tags below for booleans and
+// numbers, and points to the object header otherwise. The payload of
+// booleans and numbers is kept in bits.
+// The zero Value is nil.
 type Value struct {
-	kind ValueKind
-	data unsafe.Pointer
+	obj  *Obj
+	bits uint64
+}
+
+// The address of each tag is what matters, they are never read.
+var (
+	boolTag   = &Obj{}
+	numberTag = &Obj{}
+)
+
+// TypeError is returned by the checked accessors when a value does not
+// have the requested type.
+type TypeError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("expected %s but got %s", e.Expected, e.Actual)
 }
 
 func NewBool(value bool) Value {
-	return Value{
-		kind: VAL_BOOL,
-		data: unsafe.Pointer(&value),
+	v := Value{obj: boolTag}
+	if value {
+		v.bits = 1
 	}
+	return v
 }
 
 func NewNumber(value Number) Value {
 	return Value{
-		kind: VAL_NUMBER,
-		data: unsafe.Pointer(&value),
+		obj:  numberTag,
+		bits: math.Float64bits(float64(value)),
 	}
 }
 
 func NewNil() Value {
-	return Value{kind: VAL_NIL}
+	return Value{}
 }
 
-func NewObj(value *Obj) Value {
-	return Value{
-		kind: VAL_OBJ,
-		data: unsafe.Pointer(value),
-	}
+func NewObj(value Object) Value {
+	return Value{obj: value.header()}
 }
 
-func NewObjString(s []byte) Value {
-	obj_str := CopyString(s)
-	return NewObj((*Obj)(unsafe.Pointer(&obj_str)))
+func NewObjString(heap *Heap, s []byte) Value {
+	return NewObj(CopyString(heap, s))
 }
 
-func (v Value) AsBool() bool {
+func NewObjFunction(f *ObjFunction) Value {
+	return NewObj(f)
+}
+
+func NewObjClosure(c *ObjClosure) Value {
+	return NewObj(c)
+}
+
+func NewObjClass(c *ObjClass) Value {
+	return NewObj(c)
+}
+
+func NewObjInstance(i *ObjInstance) Value {
+	return NewObj(i)
+}
+
+func NewObjBoundMethod(b *ObjBoundMethod) Value {
+	return NewObj(b)
+}
+
+func NewObjNative(n *ObjNative) Value {
+	return NewObj(n)
+}
+
+// Name of the value's type, as shown in error messages.
+func (v Value) TypeName() string {
+	switch v.Kind() {
+	case VAL_BOOL:
+		return "bool"
+	case VAL_NIL:
+		return "nil"
+	case VAL_NUMBER:
+		return "number"
+	default:
+		return v.obj.self.TypeName()
+	}
+}
+
+func (v Value) Bool() (bool, error) {
 	if !v.IsBool() {
-		panic("Value is not a boolean.")
+		return false, &TypeError{Expected: "bool", Actual: v.TypeName()}
 	}
-	return *(*bool)(v.data)
+	return v.bits != 0, nil
 }
 
-func (v Value) AsNumber() Number {
+func (v Value) Number() (Number, error) {
 	if !v.IsNumber() {
-		panic("Value is not a number.")
+		return 0, &TypeError{Expected: "number", Actual: v.TypeName()}
 	}
-	return *(*Number)(v.data)
+	return Number(math.Float64frombits(v.bits)), nil
 }
 
-func (v Value) AsObj() Obj {
+func (v Value) Object() (Object, error) {
 	if !v.IsObj() {
-		panic("Value is not an object.")
+		return nil, &TypeError{Expected: "object", Actual: v.TypeName()}
 	}
-	return *(*Obj)(v.data)
+	return v.obj.self, nil
 }
 
-func (v Value) AsString() *ObjString {
-	if !v.IsString() {
-		panic("Value is not a string.")
+// Cast returns the object stored in v as the concrete object type T,
+// for example Cast[*ObjString](v).
+func Cast[T Object](v Value) (T, error) {
+	if v.IsObj() {
+		if o, ok := v.obj.self.(T); ok {
+			return o, nil
+		}
 	}
-	return (*ObjString)(v.data)
+	var zero T
+	return zero, &TypeError{Expected: zero.TypeName(), Actual: v.TypeName()}
 }
 
-func (v Value) AsGoString() string {
-	if !v.IsString() {
-		panic("Value is not a string.")
+// Is reports whether v holds an object of type T.
+func Is[T Object](v Value) bool {
+	if !v.IsObj() {
+		return false
+	}
+	_, ok := v.obj.self.(T)
+	return ok
+}
+
+// The As accessors are for values whose type was already checked,
+// they panic on a type mismatch.
+
+func must[T any](x T, err error) T {
+	if err != nil {
+		panic(err)
 	}
-	obj_str_ptr := (*ObjString)(v.data)
-	return string(obj_str_ptr.Bytes)
+	return x
+}
+
+func (v Value) AsBool() bool {
+	return must(v.Bool())
+}
+
+func (v Value) AsNumber() Number {
+	return must(v.Number())
+}
+
+func (v Value) AsObject() Object {
+	return must(v.Object())
+}
+
+func (v Value) AsString() *ObjString {
+	return must(Cast[*ObjString](v))
+}
+
+func (v Value) AsGoString() string {
+	return string(v.AsString().Bytes)
+}
+
+func (v Value) AsFunction() *ObjFunction {
+	return must(Cast[*ObjFunction](v))
+}
+
+func (v Value) AsClosure() *ObjClosure {
+	return must(Cast[*ObjClosure](v))
+}
+
+func (v Value) AsClass() *ObjClass {
+	return must(Cast[*ObjClass](v))
+}
+
+func (v Value) AsInstance() *ObjInstance {
+	return must(Cast[*ObjInstance](v))
+}
+
+func (v Value) AsBoundMethod() *ObjBoundMethod {
+	return must(Cast[*ObjBoundMethod](v))
+}
+
+func (v Value) AsNative() *ObjNative {
+	return must(Cast[*ObjNative](v))
 }
 
 func (v Value) ObjKind() ObjKind {
-	return v.AsObj().kind
+	return v.AsObject().Kind()
+}
+
+func (v Value) Kind() ValueKind {
+	switch v.obj {
+	case nil:
+		return VAL_NIL
+	case boolTag:
+		return VAL_BOOL
+	case numberTag:
+		return VAL_NUMBER
+	default:
+		return VAL_OBJ
+	}
 }
 
 func (v Value) IsBool() bool {
-	return v.kind == VAL_BOOL
+	return v.obj == boolTag
 }
 
 func (v Value) IsNumber() bool {
-	return v.kind == VAL_NUMBER
+	return v.obj == numberTag
 }
 
 func (v Value) IsNil() bool {
-	return v.kind == VAL_NIL
+	return v.obj == nil
 }
 
 func (v Value) IsObj() bool {
-	return v.kind == VAL_OBJ
+	return v.Kind() == VAL_OBJ
 }
 
 func (v Value) IsString() bool {
-	return v.IsObj() && (v.ObjKind() == OBJ_STRING)
+	return Is[*ObjString](v)
+}
+
+func (v Value) IsFunction() bool {
+	return Is[*ObjFunction](v)
+}
+
+func (v Value) IsClosure() bool {
+	return Is[*ObjClosure](v)
+}
+
+func (v Value) IsClass() bool {
+	return Is[*ObjClass](v)
+}
+
+func (v Value) IsInstance() bool {
+	return Is[*ObjInstance](v)
+}
+
+func (v Value) IsBoundMethod() bool {
+	return Is[*ObjBoundMethod](v)
+}
+
+func (v Value) IsNative() bool {
+	return Is[*ObjNative](v)
 }
 
 func ValuesEqual(a, b Value) bool {
-	if a.kind != b.kind {
+	if a.Kind() != b.Kind() {
 		return false
 	}
-	switch a.kind {
+	switch a.Kind() {
 	case VAL_BOOL:
 		return a.AsBool() == b.AsBool()
 	case VAL_NIL:
@@ -124,25 +280,27 @@ func ValuesEqual(a, b Value) bool {
 	case VAL_NUMBER:
 		return a.AsNumber() == b.AsNumber()
 	case VAL_OBJ:
-		s1 := a.AsString()
-		s2 := b.AsString()
-		return s1.Length == s2.Length && bytes.Equal(s1.Bytes, s2.Bytes)
+		// Interned strings with the same content are the same object.
+		return a.obj == b.obj || a.obj.kind != OBJ_STRING && a.obj.self.Equals(b.obj.self)
 	default:
 		panic("Should be unreachable (valuesEqual).")
 	}
 }
 
 func PrintValue(x Value) {
-	switch x.kind {
+	FprintValue(os.Stdout, x)
+}
+
+func FprintValue(w io.Writer, x Value) {
+	switch x.Kind() {
 	case VAL_BOOL:
-		fmt.Printf("%t", x.AsBool())
+		fmt.Fprintf(w, "%t", x.AsBool())
 	case VAL_NIL:
-		fmt.Printf("nil")
+		fmt.Fprintf(w, "nil")
 	case VAL_NUMBER:
-		fmt.Printf("%g", x.AsNumber())
+		fmt.Fprintf(w, "%g", x.AsNumber())
 	case VAL_OBJ:
-		// TODO check obj kind.
-		fmt.Printf("%s", x.AsGoString())
+		x.AsObject().Print(w)
 	default:
 		panic("Unknown value type.")
 	}
@@ -1,6 +1,8 @@
 package chunk
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 	"unsafe"
@@ -9,18 +11,23 @@ import (
 )
 
 func TestValuesEqualSameType(t *testing.T) {
+	var heap Heap
 	assert.AssertEqual(t, ValuesEqual(NewNil(), NewNil()), true)
 	assert.AssertEqual(t, ValuesEqual(NewBool(true), NewBool(true)), true)
 	assert.AssertEqual(t, ValuesEqual(NewBool(true), NewBool(false)), false)
 	assert.AssertEqual(t, ValuesEqual(NewNumber(3.0), NewNumber(3.0)), true)
 	assert.AssertEqual(t, ValuesEqual(NewNumber(3.0), NewNumber(4.0)), false)
-	assert.AssertEqual(t, ValuesEqual(NewObjString([]byte("hello")), NewObjString([]byte("hello"))), true)
-	assert.AssertEqual(t, ValuesEqual(NewObjString([]byte("a")), NewObjString([]byte("aa"))), false)
-	assert.AssertEqual(t, ValuesEqual(NewObjString([]byte("hello")), NewObjString([]byte("dummy"))), false)
+	assert.AssertEqual(t, ValuesEqual(NewObjString(&heap, []byte("hello")), NewObjString(&heap, []byte("hello"))), true)
+	assert.AssertEqual(t, ValuesEqual(NewObjString(&heap, []byte("a")), NewObjString(&heap, []byte("aa"))), false)
+	assert.AssertEqual(t, ValuesEqual(NewObjString(&heap, []byte("hello")), NewObjString(&heap, []byte("dummy"))), false)
+	// Strings are compared by identity, only strings interned together are equal.
+	var other Heap
+	assert.AssertEqual(t, ValuesEqual(NewObjString(&heap, []byte("hello")), NewObjString(&other, []byte("hello"))), false)
 }
 
 func TestValuesEqualDifferentType(t *testing.T) {
-	s1 := NewObjString([]byte("hello"))
+	var heap Heap
+	s1 := NewObjString(&heap, []byte("hello"))
 	assert.AssertEqual(t, ValuesEqual(NewNil(), NewBool(true)), false)
 	assert.AssertEqual(t, ValuesEqual(NewNil(), NewNumber(3.0)), false)
 	assert.AssertEqual(t, ValuesEqual(NewNil(), s1), false)
@@ -32,8 +39,8 @@ func TestValuesEqualDifferentType(t *testing.T) {
 }
 
 func TestObjValue(t *testing.T) {
-	obj1 := Obj{kind: OBJ_STRING}
-	value1 := NewObj(&obj1)
+	var heap Heap
+	value1 := NewObj(CopyString(&heap, []byte("a")))
 	assert.AssertEqual(t, value1.ObjKind(), OBJ_STRING)
 	assert.Assert(t, value1.IsString())
 }
@@ -50,9 +57,10 @@ func TestDoublePtr(t *testing.T) {
 }
 
 func TestCopyString(t *testing.T) {
+	var heap Heap
 	s1 := []byte("hello")
-	obj_str := CopyString(s1)
-	value := NewObj((*Obj)(unsafe.Pointer(&obj_str)))
+	obj_str := CopyString(&heap, s1)
+	value := NewObj(obj_str)
 	assert.Assert(t, value.IsString())
 	assert.AssertEqual(t, value.AsGoString(), "hello")
 	s1[0] = 'T'
@@ -60,11 +68,108 @@ func TestCopyString(t *testing.T) {
 }
 
 func TestTakeString(t *testing.T) {
+	var heap Heap
 	s1 := []byte("hello")
-	obj_str := TakeString(s1)
-	value := NewObj((*Obj)(unsafe.Pointer(&obj_str)))
+	obj_str := TakeString(&heap, s1)
+	value := NewObj(obj_str)
 	assert.Assert(t, value.IsString())
 	assert.AssertEqual(t, value.AsGoString(), "hello")
 	s1[0] = 'T'
 	assert.AssertEqual(t, value.AsGoString(), "Tello")
 }
+
+func TestInterning(t *testing.T) {
+	var heap Heap
+	s1 := CopyString(&heap, []byte("hello"))
+	s2 := CopyString(&heap, []byte("hello"))
+	s3 := TakeString(&heap, []byte("hel"+"lo"))
+	assert.Assert(t, s1 == s2)
+	assert.Assert(t, s1 == s3)
+	assert.Assert(t, CopyString(&heap, []byte("world")) != s1)
+}
+
+func TestCheckedAccessors(t *testing.T) {
+	var heap Heap
+	str := NewObjString(&heap, []byte("hello"))
+
+	n, err := NewNumber(2).Number()
+	assert.AssertEqual(t, err, nil)
+	assert.AssertEqual(t, n, Number(2))
+
+	s, err := Cast[*ObjString](str)
+	assert.AssertEqual(t, err, nil)
+	assert.AssertEqual(t, string(s.Bytes), "hello")
+
+	_, err = str.Number()
+	var typeErr *TypeError
+	assert.Assert(t, errors.As(err, &typeErr))
+	assert.AssertEqual(t, typeErr.Expected, "number")
+	assert.AssertEqual(t, typeErr.Actual, "string")
+
+	_, err = Cast[*ObjInstance](NewNil())
+	assert.Assert(t, errors.As(err, &typeErr))
+	assert.AssertEqual(t, typeErr.Error(), "expected instance but got nil")
+
+	_, err = NewBool(true).Object()
+	assert.Assert(t, errors.As(err, &typeErr))
+
+	assert.Assert(t, Is[*ObjString](str))
+	assert.Assert(t, !Is[*ObjClass](str))
+}
+
+func TestObjectInterface(t *testing.T) {
+	var heap Heap
+	name := CopyString(&heap, []byte("Foo"))
+	class := NewClass(&heap, name)
+	instance := NewObjInstance(NewInstance(&heap, class))
+
+	var b bytes.Buffer
+	instance.AsObject().Print(&b)
+	assert.AssertEqual(t, b.String(), "Foo instance")
+	assert.AssertEqual(t, instance.TypeName(), "instance")
+	assert.AssertEqual(t, instance.ObjKind(), OBJ_INSTANCE)
+	assert.Assert(t, ValuesEqual(instance, instance))
+	assert.Assert(t, !ValuesEqual(instance, NewObjInstance(NewInstance(&heap, class))))
+	assert.AssertEqual(t, name.Hash(), hashString([]byte("Foo")))
+}
+
+func TestValueSize(t *testing.T) {
+	assert.AssertEqual(t, unsafe.Sizeof(Value{}), uintptr(16))
+	assert.Assert(t, Value{}.IsNil())
+}
+
+func TestPrimitivesDoNotAllocate(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		a := NewNumber(1.5)
+		b := NewNumber(2.5)
+		c := NewNumber(a.AsNumber() + b.AsNumber())
+		d := NewBool(ValuesEqual(c, NewNumber(4.0)))
+		if !d.AsBool() || NewNil().IsNumber() {
+			t.Fatal("unexpected value")
+		}
+	})
+	assert.AssertEqual(t, allocs, 0.0)
+}
+
+func BenchmarkNumberArithmetic(b *testing.B) {
+	b.ReportAllocs()
+	sum := NewNumber(0)
+	one := NewNumber(1)
+	for i := 0; i < b.N; i++ {
+		sum = NewNumber(sum.AsNumber() + one.AsNumber())
+	}
+	if sum.AsNumber() != Number(b.N) {
+		b.Fatal("wrong sum")
+	}
+}
+
+func BenchmarkBoolComparison(b *testing.B) {
+	b.ReportAllocs()
+	x := NewNumber(3)
+	y := NewNumber(4)
+	for i := 0; i < b.N; i++ {
+		if !NewBool(x.AsNumber() < y.AsNumber()).AsBool() {
+			b.Fatal("wrong comparison")
+		}
+	}
+}
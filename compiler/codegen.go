@@ -0,0 +1,495 @@
+package compiler
+
+import (
+	"math"
+
+	"github.com/jeroendm/glox/ast"
+	"github.com/jeroendm/glox/chunk"
+)
+
+// generator compiles a syntax tree with the emit, scope and resolve functions
+// of the single-pass compiler. Before compiling each part of the tree it
+// points prev at the token the single-pass compiler would have just consumed,
+// so the bytecode, its positions and the diagnostics are the same.
+type generator struct {
+	Compiler
+	last ast.Stmt // the last declaration of the script, see ReturnLastExpression
+}
+
+// The token kinds of the operators of unary and binary expressions.
+var operators = map[string]TokenKind{
+	"!":  T_BANG,
+	"!=": T_BANG_EQUAL,
+	"==": T_EQUAL_EQUAL,
+	">":  T_GREATER,
+	">=": T_GREATER_EQUAL,
+	"<":  T_LESS,
+	"<=": T_LESS_EQUAL,
+	"+":  T_PLUS,
+	"-":  T_MINUS,
+	"*":  T_STAR,
+	"/":  T_SLASH,
+}
+
+// Compile a syntax tree into the chunk, like Compile compiles the source it
+// was parsed from. Tools can inspect or rewrite the tree in between.
+// A tree that Parse built without errors compiles to the same bytecode. If a
+// rewritten tree has errors the result is an *Error with all diagnostics, an
+// *ast.BadExpr is reported as a missing expression and a node that Parse does
+// not build, such as a nil node or an unknown operator, as invalid.
+func CompileFile(file *ast.File, target *chunk.Chunk, heap *chunk.Heap, options ...Option) error {
+	g := &generator{
+		Compiler: Compiler{
+			Parser: Parser{heap: heap},
+			target: target,
+		},
+	}
+	for _, option := range options {
+		option(&g.Parser)
+	}
+	if g.genFile(file); g.hadError {
+		return &Error{Diagnostics: g.diagnostics}
+	}
+	return nil
+}
+
+func (g *generator) token(kind TokenKind, lexeme string, pos chunk.Position) *Token {
+	return &Token{
+		kind:   kind,
+		lexeme: []byte(lexeme),
+		line:   pos.Line,
+		column: pos.Column,
+		start:  pos.Offset,
+		end:    pos.Offset + len(lexeme),
+	}
+}
+
+// Make the token the previous token, as if the compiler just consumed it.
+func (g *generator) at(kind TokenKind, lexeme string, pos chunk.Position) *Token {
+	g.prev = g.token(kind, lexeme, pos)
+	return g.prev
+}
+
+func (g *generator) atIdent(id *ast.Ident) *Token {
+	if id == nil {
+		return g.invalid("Invalid identifier node.")
+	}
+	return g.at(T_IDENTIFIER, id.Name, id.NamePos)
+}
+
+// Report a node that Parse does not build, such as a nil node, after the
+// previous token. The error token takes the place of the node.
+func (g *generator) invalid(msg string) *Token {
+	var pos chunk.Position
+	if g.prev != nil {
+		pos = g.prev.position()
+	}
+	g.at(T_ERROR, "", pos)
+	g.errorAtPrev(msg)
+	return g.prev
+}
+
+func (g *generator) genFile(file *ast.File) {
+	if n := len(file.Decls); n > 0 {
+		g.last = file.Decls[n-1]
+	}
+	g.compileScript(func() {
+		g.genDeclarations(file.Decls)
+		g.at(T_EOF, "", file.EOF)
+	})
+}
+
+// Errors are reported again after each declaration, like the single-pass
+// compiler does once it synchronizes.
+func (g *generator) genDeclarations(list []ast.Stmt) {
+	for _, decl := range list {
+		g.genStmt(decl)
+		g.panicMode = false
+	}
+}
+
+// Compiling a node leaves prev at the last token of the node.
+func (g *generator) genStmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.ExprStmt:
+		g.genExpr(s.X)
+		g.at(T_SEMICOLON, ";", s.Semicolon)
+		if g.returnLast && g.last == s {
+			g.emitByte(byte(chunk.OP_RETURN))
+			return
+		}
+		g.emitByte(byte(chunk.OP_POP))
+
+	case *ast.PrintStmt:
+		g.genExpr(s.X)
+		g.at(T_SEMICOLON, ";", s.Semicolon)
+		g.emitByte(byte(chunk.OP_PRINT))
+
+	case *ast.VarDecl:
+		g.atIdent(s.Name)
+		global := g.declareName()
+		if s.Init != nil {
+			g.genExpr(s.Init)
+		} else {
+			g.emitByte(byte(chunk.OP_NIL))
+		}
+		g.at(T_SEMICOLON, ";", s.Semicolon)
+		g.defineVariable(global)
+
+	case *ast.BlockStmt:
+		g.beginScope()
+		g.genDeclarations(s.List)
+		g.at(T_RIGHT_BRACE, "}", s.Rbrace)
+		g.endScope()
+
+	case *ast.IfStmt:
+		g.genExpr(s.Cond)
+		g.at(T_RIGHT_PAREN, ")", s.Rparen)
+
+		thenJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		g.emitByte(byte(chunk.OP_POP)) // Pop condition.
+		g.genStmt(s.Then)
+
+		elseJump := g.emitJump(chunk.OP_JUMP)
+
+		g.patchJump(thenJump)
+		g.emitByte(byte(chunk.OP_POP)) // Pop condition.
+
+		if s.Else != nil {
+			g.genStmt(s.Else)
+		}
+		g.patchJump(elseJump)
+
+	case *ast.WhileStmt:
+		loopStart := len(g.currentChunk().Code)
+		g.genExpr(s.Cond)
+		g.at(T_RIGHT_PAREN, ")", s.Rparen)
+
+		exitJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		g.emitByte(byte(chunk.OP_POP))
+		g.genStmt(s.Body)
+		g.emitLoop(loopStart)
+
+		g.patchJump(exitJump)
+		g.emitByte(byte(chunk.OP_POP))
+
+	case *ast.ForStmt:
+		g.genFor(s)
+
+	case *ast.ReturnStmt:
+		g.at(T_RETURN, "return", s.Return)
+		if g.current.ftype == TYPE_SCRIPT {
+			g.errorAtPrev("Can't return from top-level code.")
+		}
+
+		if s.Result == nil {
+			g.at(T_SEMICOLON, ";", s.Semicolon)
+			g.emitReturn()
+		} else {
+			if g.current.ftype == TYPE_INITIALIZER {
+				g.errorAtPrev("Can't return a value from an initializer.")
+			}
+			g.genExpr(s.Result)
+			g.at(T_SEMICOLON, ";", s.Semicolon)
+			g.emitByte(byte(chunk.OP_RETURN))
+		}
+
+	case *ast.FunDecl:
+		g.atIdent(s.Name)
+		global := g.declareName()
+		// A function may refer to itself in its body.
+		g.markInitialized()
+		g.genFunction(s, TYPE_FUNCTION)
+		g.defineVariable(global)
+
+	case *ast.ClassDecl:
+		g.genClass(s)
+
+	default:
+		g.invalid("Invalid statement node.")
+	}
+}
+
+// See forStatement, the increment clause is compiled before the body.
+func (g *generator) genFor(s *ast.ForStmt) {
+	g.beginScope()
+	if s.Init != nil {
+		g.genStmt(s.Init)
+	}
+
+	loopStart := len(g.currentChunk().Code)
+	exitJump := -1
+	if s.Cond != nil {
+		g.genExpr(s.Cond)
+		g.at(T_SEMICOLON, ";", s.Semicolon)
+
+		// Jump out of the loop if the condition is false.
+		exitJump = g.emitJump(chunk.OP_JUMP_IF_FALSE)
+		g.emitByte(byte(chunk.OP_POP)) // Pop condition.
+	} else {
+		g.at(T_SEMICOLON, ";", s.Semicolon)
+	}
+
+	if s.Post != nil {
+		bodyJump := g.emitJump(chunk.OP_JUMP)
+		incrementStart := len(g.currentChunk().Code)
+		g.genExpr(s.Post)
+		g.emitByte(byte(chunk.OP_POP))
+		g.at(T_RIGHT_PAREN, ")", s.Rparen)
+
+		g.emitLoop(loopStart)
+		loopStart = incrementStart
+		g.patchJump(bodyJump)
+	} else {
+		g.at(T_RIGHT_PAREN, ")", s.Rparen)
+	}
+
+	g.genStmt(s.Body)
+	g.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		g.patchJump(exitJump)
+		g.emitByte(byte(chunk.OP_POP)) // Pop condition.
+	}
+
+	g.endScope()
+}
+
+// See function, emits the closure of the function or method.
+func (g *generator) genFunction(decl *ast.FunDecl, ftype FunctionType) {
+	g.atIdent(decl.Name)
+	var fc FunctionCompiler
+	g.initCompiler(&fc, ftype)
+	g.beginScope()
+
+	for _, param := range decl.Params {
+		g.current.function.Arity++
+		name := g.atIdent(param)
+		if g.current.function.Arity > math.MaxUint8 {
+			g.errorAt(name, "Can't have more than 255 parameters.")
+		}
+		g.defineVariable(g.declareName())
+	}
+
+	if decl.Body == nil {
+		g.invalid("Invalid statement node.")
+	} else {
+		g.genDeclarations(decl.Body.List)
+		g.at(T_RIGHT_BRACE, "}", decl.Body.Rbrace)
+	}
+	g.endFunction(&fc)
+}
+
+// See classDeclaration.
+func (g *generator) genClass(s *ast.ClassDecl) {
+	className := g.atIdent(s.Name)
+	nameConstant := g.identifierConstant(className)
+	g.declareVariable()
+
+	g.emitBytes(byte(chunk.OP_CLASS), nameConstant)
+	g.defineVariable(nameConstant)
+
+	classCompiler := ClassCompiler{enclosing: g.currentClass, hasSuperclass: false}
+	g.currentClass = &classCompiler
+
+	if s.Superclass != nil {
+		g.atIdent(s.Superclass)
+		g.variable(false)
+
+		if identifiersEqual(className, g.prev) {
+			g.errorAtPrev("A class can't inherit from itself.")
+		}
+
+		g.beginScope()
+		g.addLocal(g.syntheticToken("super"))
+		g.defineVariable(0)
+
+		g.namedVariable(className, false)
+		g.emitByte(byte(chunk.OP_INHERIT))
+		classCompiler.hasSuperclass = true
+	}
+
+	// Load the class so the methods can be attached to it.
+	g.namedVariable(className, false)
+	for _, method := range s.Methods {
+		if method == nil {
+			g.invalid("Invalid statement node.")
+			continue
+		}
+		constant := g.identifierConstant(g.atIdent(method.Name))
+
+		ftype := TYPE_METHOD
+		if method.Name.Name == "init" {
+			ftype = TYPE_INITIALIZER
+		}
+		g.genFunction(method, ftype)
+		g.emitBytes(byte(chunk.OP_METHOD), constant)
+	}
+	g.at(T_RIGHT_BRACE, "}", s.Rbrace)
+	g.emitByte(byte(chunk.OP_POP))
+
+	if classCompiler.hasSuperclass {
+		g.endScope()
+	}
+
+	g.currentClass = g.currentClass.enclosing
+}
+
+func (g *generator) genExpr(expr ast.Expr) {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		g.atIdent(x)
+		g.variable(false)
+
+	case *ast.BadExpr:
+		g.at(T_ERROR, "", x.From)
+		g.errorAtPrev("Expect expression.")
+
+	case *ast.NumberLit:
+		g.at(T_NUMBER, x.Value, x.ValuePos)
+		g.number(false)
+
+	case *ast.StringLit:
+		g.at(T_STRING, `"`+x.Value+`"`, x.ValuePos)
+		g.pstring(false)
+
+	case *ast.BoolLit:
+		if x.Value {
+			g.at(T_TRUE, "true", x.ValuePos)
+		} else {
+			g.at(T_FALSE, "false", x.ValuePos)
+		}
+		g.literal(false)
+
+	case *ast.NilLit:
+		g.at(T_NIL, "nil", x.ValuePos)
+		g.literal(false)
+
+	case *ast.ParenExpr:
+		g.genExpr(x.X)
+		g.at(T_RIGHT_PAREN, ")", x.Rparen)
+
+	case *ast.UnaryExpr:
+		g.genExpr(x.X)
+		if x.Op != "!" && x.Op != "-" {
+			g.errorAt(g.token(T_ERROR, "", x.OpPos), "Invalid unary operator.")
+			break
+		}
+		g.emitUnaryOp(g.token(operators[x.Op], x.Op, x.OpPos))
+
+	case *ast.BinaryExpr:
+		g.genExpr(x.X)
+		switch x.Op {
+		case "and":
+			g.at(T_AND, "and", x.OpPos)
+			endJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+
+			g.emitByte(byte(chunk.OP_POP))
+			g.genExpr(x.Y)
+
+			g.patchJump(endJump)
+		case "or":
+			g.at(T_OR, "or", x.OpPos)
+			elseJump := g.emitJump(chunk.OP_JUMP_IF_FALSE)
+			endJump := g.emitJump(chunk.OP_JUMP)
+
+			g.patchJump(elseJump)
+			g.emitByte(byte(chunk.OP_POP))
+
+			g.genExpr(x.Y)
+			g.patchJump(endJump)
+		default:
+			g.genExpr(x.Y)
+			kind, ok := operators[x.Op]
+			if !ok || kind == T_BANG {
+				g.errorAt(g.token(T_ERROR, "", x.OpPos), "Invalid binary operator.")
+				break
+			}
+			g.emitBinaryOp(g.token(kind, x.Op, x.OpPos))
+		}
+
+	case *ast.AssignExpr:
+		name := g.atIdent(x.Name)
+		_, setOp, arg := g.resolveVariable(name)
+		g.genExpr(x.Value)
+		g.emitBytesAt(name, byte(setOp), byte(arg))
+
+	case *ast.CallExpr:
+		switch fun := x.Fun.(type) {
+		case *ast.GetExpr:
+			// Call the method directly without creating a bound method.
+			g.genExpr(fun.X)
+			property := g.atIdent(fun.Name)
+			name := g.identifierConstant(property)
+			argCount := g.genArguments(x)
+			g.emitBytesAt(property, byte(chunk.OP_INVOKE), name)
+			g.emitByteAt(property, argCount)
+		case *ast.SuperExpr:
+			g.genSuper(fun, x)
+		default:
+			g.genExpr(x.Fun)
+			argCount := g.genArguments(x)
+			g.emitBytesAt(g.token(T_LEFT_PAREN, "(", x.Lparen), byte(chunk.OP_CALL), argCount)
+		}
+
+	case *ast.GetExpr:
+		g.genExpr(x.X)
+		property := g.atIdent(x.Name)
+		g.emitBytesAt(property, byte(chunk.OP_GET_PROPERTY), g.identifierConstant(property))
+
+	case *ast.SetExpr:
+		g.genExpr(x.X)
+		property := g.atIdent(x.Name)
+		name := g.identifierConstant(property)
+		g.genExpr(x.Value)
+		g.emitBytesAt(property, byte(chunk.OP_SET_PROPERTY), name)
+
+	case *ast.ThisExpr:
+		g.at(T_THIS, "this", x.Keyword)
+		g.this_(false)
+
+	case *ast.SuperExpr:
+		g.genSuper(x, nil)
+
+	default:
+		g.invalid("Invalid expression node.")
+	}
+}
+
+// Compile the arguments of the call, see argumentList.
+func (g *generator) genArguments(call *ast.CallExpr) byte {
+	for i, arg := range call.Args {
+		g.genExpr(arg)
+		if i == math.MaxUint8 {
+			g.errorAtPrev("Can't have more than 255 arguments.")
+		}
+	}
+	g.at(T_RIGHT_PAREN, ")", call.Rparen)
+	return byte(len(call.Args))
+}
+
+// See super_, call is nil when the method is not called directly.
+func (g *generator) genSuper(x *ast.SuperExpr, call *ast.CallExpr) {
+	g.at(T_SUPER, "super", x.Keyword)
+	if g.currentClass == nil {
+		g.errorAtPrev("Can't use 'super' outside of a class.")
+	} else if !g.currentClass.hasSuperclass {
+		g.errorAtPrev("Can't use 'super' in a class with no superclass.")
+	}
+
+	method := g.atIdent(x.Method)
+	name := g.identifierConstant(method)
+
+	this := g.syntheticToken("this")
+	super := g.syntheticToken("super")
+	g.namedVariable(&this, false)
+	if call != nil {
+		argCount := g.genArguments(call)
+		g.namedVariable(&super, false)
+		g.emitBytesAt(method, byte(chunk.OP_SUPER_INVOKE), name)
+		g.emitByteAt(method, argCount)
+	} else {
+		g.namedVariable(&super, false)
+		g.emitBytesAt(method, byte(chunk.OP_GET_SUPER), name)
+	}
+}
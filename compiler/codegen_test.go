@@ -0,0 +1,220 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/jeroendm/glox/ast"
+	"github.com/jeroendm/glox/chunk"
+)
+
+// Compile the source with the AST front end.
+func compileTree(source []uint8, target *chunk.Chunk, heap *chunk.Heap, options ...Option) error {
+	file, err := Parse(source)
+	if err != nil {
+		return err
+	}
+	return CompileFile(file, target, heap, options...)
+}
+
+// Write the positions of the chunk and of the functions in its constants.
+func positionsAll(w *bytes.Buffer, c *chunk.Chunk) {
+	fmt.Fprintln(w, c.Positions)
+	for _, constant := range c.Constants {
+		if constant.IsFunction() {
+			positionsAll(w, &constant.AsFunction().Chunk)
+		}
+	}
+}
+
+func TestCompileFileSameAsCompile(t *testing.T) {
+	sources := []string{
+		"print 1 + 2 * 3;",
+		"print -(1 - 2) / 3 >= 4 == !(5 < 6) != (7 <= 8) > 9;",
+		"var a = \"a\"; { var b = a; print b; var c; c = b = \"c\"; }",
+		"fun f(x) { fun g() { return x; } return g; } print f(1)();",
+		"fun counter() { var i = 0; fun inc() { i = i + 1; return i; } return inc; } var c = counter(); c(); print c();",
+		"class A { init(x) { this.x = x; } get() { return this.x; } } class B < A { get() { return super.get() + super.get; } }",
+		"class A { method() { this.field = this.method; return; } } var a = A(); a.field = 1; print a.method().field;",
+		"class A {} class B < A {} { class C < B { init() { super.init(); } } }",
+		"for (var i = 0; i < 10; i = i + 1) { if (i > 5 and i != 7) print i; else print nil; }",
+		"var i = 0; for (i = 1; ; ) { for (;;) {} } for (; i < 2;) i = i + 1;",
+		"var x = 1; while (x < 100 or false) x = x * 2;",
+		"if (true) { fun f() {} } if (false) 1;",
+		"while (false) 2;",
+		"print true; print false; print nil; 3;",
+	}
+	files, err := filepath.Glob("testdata/errors/*.lox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, string(source))
+	}
+	sources = append(sources, mixedErrors...)
+
+	// The errors, or the disassembly and positions of the compiled source.
+	compile := func(compileFn func([]uint8, *chunk.Chunk, *chunk.Heap, ...Option) error, source string, options ...Option) string {
+		var out bytes.Buffer
+		c := chunk.MakeChunk()
+		if err := compileFn([]byte(source), &c, &chunk.Heap{}, options...); err != nil {
+			return err.Error()
+		}
+		disassembleAll(&out, &c, "<script>")
+		positionsAll(&out, &c)
+		return out.String()
+	}
+
+	for _, source := range sources {
+		for _, options := range [][]Option{nil, {ReturnLastExpression()}} {
+			expected := compile(Compile, source, options...)
+			if actual := compile(compileTree, source, options...); actual != expected {
+				t.Errorf("compiling %q with %d options gave:\n%s\nexpected:\n%s", source, len(options), actual, expected)
+			}
+		}
+	}
+}
+
+func TestCompileFileBadExpr(t *testing.T) {
+	file, err := Parse([]byte("print 1 +;"))
+	if err == nil {
+		t.Fatal("expected a syntax error")
+	}
+	c := chunk.MakeChunk()
+	err = CompileFile(file, &c, &chunk.Heap{})
+	var compileErr *Error
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if expected := "[line 1] Error: Expect expression."; compileErr.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, compileErr.Error())
+	}
+}
+
+// A rewritten tree can hold nodes that Parse does not build, they are
+// reported instead of compiled.
+func TestCompileFileInvalidNodes(t *testing.T) {
+	pos := chunk.Position{Line: 2, Column: 1}
+	ident := &ast.Ident{NamePos: pos, Name: "a"}
+	one := &ast.NumberLit{ValuePos: pos, Value: "1"}
+	tests := []struct {
+		decl     ast.Stmt
+		expected string
+	}{
+		{nil, "[line 0] Error: Invalid statement node."},
+		{&ast.PrintStmt{X: nil}, "[line 0] Error: Invalid expression node."},
+		{&ast.VarDecl{Name: nil, Init: one}, "[line 0] Error: Invalid identifier node."},
+		{&ast.PrintStmt{X: &ast.UnaryExpr{OpPos: pos, Op: "+", X: one}}, "[line 2] Error: Invalid unary operator."},
+		{&ast.PrintStmt{X: &ast.BinaryExpr{X: one, OpPos: pos, Op: "!", Y: one}}, "[line 2] Error: Invalid binary operator."},
+		{&ast.PrintStmt{X: &ast.BinaryExpr{X: one, OpPos: pos, Op: "%", Y: one}}, "[line 2] Error: Invalid binary operator."},
+		{&ast.PrintStmt{X: &ast.NumberLit{ValuePos: pos, Value: "1.2.3"}}, "[line 2] Error at '1.2.3': Invalid number."},
+		{&ast.FunDecl{Name: ident, Body: nil}, "[line 2] Error: Invalid statement node."},
+		{&ast.FunDecl{Name: ident, Params: []*ast.Ident{nil}, Body: &ast.BlockStmt{}}, "[line 2] Error: Invalid identifier node."},
+		{&ast.ClassDecl{Name: ident, Methods: []*ast.FunDecl{nil}}, "[line 2] Error: Invalid statement node."},
+		{&ast.IfStmt{Cond: one, Rparen: pos, Then: nil}, "[line 2] Error: Invalid statement node."},
+		{&ast.PrintStmt{X: &ast.GetExpr{X: ident, Name: nil}}, "[line 2] Error: Invalid identifier node."},
+	}
+	for _, test := range tests {
+		file := &ast.File{Decls: []ast.Stmt{test.decl}}
+		c := chunk.MakeChunk()
+		err := CompileFile(file, &c, &chunk.Heap{})
+		var compileErr *Error
+		if !errors.As(err, &compileErr) {
+			t.Errorf("%#v: expected an *Error, got %v", test.decl, err)
+		} else if compileErr.Error() != test.expected {
+			t.Errorf("%#v: expected %q, got %q", test.decl, test.expected, compileErr.Error())
+		}
+	}
+}
+
+// Sources with syntax errors and other errors, after which Compile skips to
+// the next statement.
+var mixedErrors = []string{
+	"return \n\n fun ( * 2.5",
+	"class A < A {} { var a = a; var a; } return 1;",
+	"fun f( { return 1; }\nclass A < A {}\nvar a = 1 +;\n{ var b = b; }",
+}
+
+// The tree is built by the parser of Compile, Parse reports the same errors.
+func TestParseErrors(t *testing.T) {
+	for _, source := range mixedErrors {
+		c := chunk.MakeChunk()
+		var expected *Error
+		if !errors.As(Compile([]byte(source), &c, &chunk.Heap{}), &expected) {
+			t.Fatalf("expected %q not to compile", source)
+		}
+		file, err := Parse([]byte(source))
+		var actual *Error
+		if !errors.As(err, &actual) || !slices.Equal(actual.Diagnostics, expected.Diagnostics) {
+			t.Errorf("Parse %q: expected:\n%v\ngot:\n%v", source, expected, err)
+		}
+		if file == nil || len(file.Decls) == 0 {
+			t.Errorf("Parse %q: expected a partial tree", source)
+		}
+	}
+}
+
+// Tools can rewrite the tree before compiling it.
+func TestCompileRewrittenFile(t *testing.T) {
+	file, err := Parse([]byte("print 1 + 2;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		if x, ok := node.(*ast.NumberLit); ok {
+			x.Value += "0"
+		}
+		return true
+	})
+
+	c := chunk.MakeChunk()
+	if err := CompileFile(file, &c, &chunk.Heap{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []chunk.Number{10, 20} {
+		if actual := c.Constants[i].AsNumber(); actual != expected {
+			t.Errorf("constant %d: expected %v, got %v", i, expected, actual)
+		}
+	}
+}
+
+const benchmarkSource = `
+class Point {
+  init(x, y) { this.x = x; this.y = y; }
+  add(other) { return Point(this.x + other.x, this.y + other.y); }
+}
+fun sum(n) {
+  var p = Point(0, 0);
+  for (var i = 0; i < n; i = i + 1) p = p.add(Point(i, -i));
+  return p;
+}
+print sum(100).x;
+`
+
+func BenchmarkCompile(b *testing.B) {
+	for range b.N {
+		c := chunk.MakeChunk()
+		if err := Compile([]byte(benchmarkSource), &c, &chunk.Heap{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compare with BenchmarkCompile for the cost of building the tree.
+func BenchmarkParseAndCompileFile(b *testing.B) {
+	for range b.N {
+		c := chunk.MakeChunk()
+		if err := compileTree([]byte(benchmarkSource), &c, &chunk.Heap{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
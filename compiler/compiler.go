@@ -1,22 +1,46 @@
 package compiler
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"math"
-	"os"
 	"strconv"
-	"unsafe"
 
+	"github.com/jeroendm/glox/ast"
 	"github.com/jeroendm/glox/chunk"
 )
 
 type Parser struct {
-	curr           *Token
-	prev           *Token
-	tokens         chan Token
-	hadError       bool
-	panicMode      bool
-	compilingChunk *chunk.Chunk
+	curr        *Token
+	prev        *Token
+	tokens      chan Token
+	hadError    bool
+	panicMode   bool
+	heap        *chunk.Heap // functions and string constants are allocated here
+	source      []byte
+	diagnostics []Diagnostic // in the order they are found
+	debug       io.Writer    // source and disassembly of compiled functions, nil to disable
+	returnLast  bool         // see ReturnLastExpression
+}
+
+// An Option configures a single call to Compile.
+type Option func(*Parser)
+
+// Make the script return the value of its last statement, when that is an
+// expression statement, instead of nil. This is what a REPL or an embedding
+// API wants to show.
+func ReturnLastExpression() Option {
+	return func(p *Parser) {
+		p.returnLast = true
+	}
+}
+
+// Write the source and the disassembly of each compiled function to w.
+func Debug(w io.Writer) Option {
+	return func(p *Parser) {
+		p.debug = w
+	}
 }
 
 type Precedence int
@@ -35,55 +59,137 @@ const (
 	PREC_PRIMARY
 )
 
+// Parse functions receive canAssign so that identifiers only consume a
+// trailing '=' when the surrounding precedence allows an assignment.
+// They return the node of the expression when the tree is built, see Parse.
+type ParseFn func(canAssign bool) ast.Expr
+
+// Like ParseFn for an infix operator, left is the node of its left operand.
+type InfixFn func(left ast.Expr, canAssign bool) ast.Expr
+
 type ParseRule struct {
-	prefix func()
-	infix  func()
+	prefix ParseFn
+	infix  InfixFn
 	prec   Precedence
 }
 
-var p Parser
-var rules [T_NUM_TOKENS]ParseRule
+// Maximum number of locals in scope at once, slots are addressed with a single byte.
+const UINT8_COUNT = math.MaxUint8 + 1
+
+type Local struct {
+	name       Token
+	depth      int  // -1 while the variable's initializer is being compiled
+	isCaptured bool // captured by a closure, so it must be moved off the stack at scope exit
+}
+
+// A variable captured from an enclosing function. Either a local of the
+// directly enclosing function, or one of that function's own upvalues.
+type Upvalue struct {
+	index   uint8
+	isLocal bool
+}
+
+type FunctionType int
+
+const (
+	TYPE_FUNCTION FunctionType = iota
+	TYPE_INITIALIZER
+	TYPE_METHOD
+	TYPE_SCRIPT
+)
+
+// FunctionCompiler keeps track of the function being compiled, its local
+// variables and the current block depth. Locals are stored in the order they
+// are declared, which matches their stack slot at runtime.
+// There is one FunctionCompiler per function, linked to the function it is
+// nested in.
+type FunctionCompiler struct {
+	enclosing  *FunctionCompiler
+	function   *chunk.ObjFunction
+	ftype      FunctionType
+	locals     [UINT8_COUNT]Local
+	localCount int
+	upvalues   [UINT8_COUNT]Upvalue
+	scopeDepth int // zero is the global scope
+}
+
+// ClassCompiler tracks the class whose body is being compiled,
+// linked to the enclosing class for nested class declarations.
+type ClassCompiler struct {
+	enclosing     *ClassCompiler
+	hasSuperclass bool
+}
 
-func prettyPrint(token Token, prev_line int) {
+// Compiler holds all state of a single call to Compile, so separate
+// goroutines can compile at the same time.
+type Compiler struct {
+	Parser
+	current      *FunctionCompiler
+	currentClass *ClassCompiler
+	rules        [T_NUM_TOKENS]ParseRule // bound to this Compiler, see makeRules
+	target       *chunk.Chunk            // the top-level script is compiled into this chunk
+	tree         bool                    // build a syntax tree while compiling, see Parse
+	file         *ast.File               // the tree, once the script is compiled
+}
+
+func prettyPrint(w io.Writer, token Token, prev_line int) {
 	if token.line != prev_line {
-		fmt.Printf("%4d ", token.line)
+		fmt.Fprintf(w, "%4d ", token.line)
 	} else {
-		fmt.Print("   | ")
+		fmt.Fprint(w, "   | ")
 	}
-	fmt.Printf("%-20v '%s'\n", token.kind, token.lexeme)
+	fmt.Fprintf(w, "%-20v '%s'\n", token.kind, token.lexeme)
 }
 
-func currentChunk() *chunk.Chunk {
-	return p.compilingChunk
+func (t *Token) position() chunk.Position {
+	return chunk.Position{Line: t.line, Column: t.column, Offset: t.start}
 }
 
-// Main error functions, the others are just wrappers around this one.
-func errorAt(t *Token, msg string) {
-	p.panicMode = true
+func (t *Token) ident() *ast.Ident {
+	return &ast.Ident{NamePos: t.position(), Name: string(t.lexeme)}
+}
 
-	fmt.Fprintf(os.Stderr, "[line %d] Error", t.line)
+func (c *Compiler) currentChunk() *chunk.Chunk {
+	return &c.current.function.Chunk
+}
 
-	if t.kind == T_EOF {
-		fmt.Fprintf(os.Stderr, " at end")
-	} else if t.kind == T_ERROR {
-		// nothing
-	} else {
-		fmt.Fprintf(os.Stderr, " at '%s'", t.lexeme)
+// Main error functions, the others are just wrappers around this one.
+func (p *Parser) errorAt(t *Token, msg string) {
+	// Suppress the errors that follow from the first one, until the parser
+	// is back in sync at the next statement.
+	if p.panicMode {
+		return
 	}
+	p.panicMode = true
 
-	fmt.Fprintf(os.Stderr, ": %s\n", msg)
+	lexeme := t.lexeme
+	if t.kind == T_ERROR && p.source != nil {
+		// The lexeme is the message, report the source the scanner stopped at.
+		// CompileFile has no source, a bad expression is reported without it.
+		lexeme = p.source[t.start:t.end]
+	}
+	p.diagnostics = append(p.diagnostics, Diagnostic{
+		Severity: SEVERITY_ERROR,
+		Message:  msg,
+		Kind:     t.kind,
+		Lexeme:   string(lexeme),
+		Line:     t.line,
+		Column:   t.column,
+		Start:    t.start,
+		End:      t.end,
+	})
 	p.hadError = true
 }
 
-func errorAtPrev(msg string) {
-	errorAt(p.prev, msg)
+func (p *Parser) errorAtPrev(msg string) {
+	p.errorAt(p.prev, msg)
 }
 
-func errorAtCurr(msg string) {
-	errorAt(p.curr, msg)
+func (p *Parser) errorAtCurr(msg string) {
+	p.errorAt(p.curr, msg)
 }
 
-func advance() {
+func (p *Parser) advance() {
 	p.prev = p.curr
 
 	// report and skip errors
@@ -92,170 +198,476 @@ func advance() {
 		if p.curr.kind != T_ERROR {
 			break
 		}
-		errorAtCurr(string(p.curr.lexeme))
+		p.errorAtCurr(string(p.curr.lexeme))
 	}
 }
 
 // Foundation for reporting syntax errors in compiler.
 // https://craftinginterpreters.com/compiling-expressions.html#handling-syntax-errors
-func consume(t TokenKind, errMsg string) {
+func (p *Parser) consume(t TokenKind, errMsg string) {
 	if p.curr.kind == t {
-		advance()
+		p.advance()
 	} else {
-		errorAtCurr(errMsg)
+		p.errorAtCurr(errMsg)
+	}
+}
+
+func (p *Parser) check(t TokenKind) bool {
+	return p.curr.kind == t
+}
+
+// Consume the current token only if it has the given kind.
+func (p *Parser) match(t TokenKind) bool {
+	if !p.check(t) {
+		return false
 	}
+	p.advance()
+	return true
 }
 
-func emitByte(b byte) {
-	currentChunk().Write(b, p.prev.line)
+func (c *Compiler) emitByte(b byte) {
+	c.emitByteAt(c.prev, b)
 }
 
-func emitBytes(b1, b2 byte) {
-	emitByte(b1)
-	emitByte(b2)
+func (c *Compiler) emitBytes(b1, b2 byte) {
+	c.emitByte(b1)
+	c.emitByte(b2)
 }
 
-func endCompiler() {
-	// Temporary, (and inline version of 'emitReturn' function).
-	emitByte(byte(chunk.OP_RETURN))
+// Emit at the position of t instead of the previous token. Instructions that
+// can fail at runtime are emitted at the operator or name they were compiled
+// from, so the error points there rather than at the end of an operand.
+func (c *Compiler) emitByteAt(t *Token, b byte) {
+	c.currentChunk().Write(b, t.position())
+}
 
-	// TODO ifdef debug
-	if !p.hadError {
-		p.compilingChunk.Disassemble("code")
+func (c *Compiler) emitBytesAt(t *Token, b1, b2 byte) {
+	c.emitByteAt(t, b1)
+	c.emitByteAt(t, b2)
+}
+
+// Emit a jump instruction with a placeholder operand and return the offset
+// of the operand so it can be patched later.
+func (c *Compiler) emitJump(instruction chunk.OpCode) int {
+	c.emitByte(byte(instruction))
+	c.emitBytes(0xff, 0xff)
+	return len(c.currentChunk().Code) - 2
+}
+
+// Backpatch the jump operand at offset to land on the next instruction emitted.
+func (c *Compiler) patchJump(offset int) {
+	// -2 to adjust for the bytecode for the jump offset itself.
+	jump := len(c.currentChunk().Code) - offset - 2
+
+	if jump > math.MaxUint16 {
+		c.errorAtPrev("Too much code to jump over.")
+	}
+
+	c.currentChunk().Code[offset] = byte((jump >> 8) & 0xff)
+	c.currentChunk().Code[offset+1] = byte(jump & 0xff)
+}
+
+func (c *Compiler) emitLoop(loopStart int) {
+	c.emitByte(byte(chunk.OP_LOOP))
+
+	// +2 to also jump over the operand of OP_LOOP.
+	offset := len(c.currentChunk().Code) - loopStart + 2
+	if offset > math.MaxUint16 {
+		c.errorAtPrev("Loop body too large.")
+	}
+
+	c.emitBytes(byte((offset>>8)&0xff), byte(offset&0xff))
+}
+
+// Functions without a return statement implicitly return nil,
+// initializers return the new instance in slot zero.
+func (c *Compiler) emitReturn() {
+	if c.current.ftype == TYPE_INITIALIZER {
+		c.emitBytes(byte(chunk.OP_GET_LOCAL), 0)
+	} else {
+		c.emitByte(byte(chunk.OP_NIL))
+	}
+	c.emitByte(byte(chunk.OP_RETURN))
+}
+
+func (c *Compiler) initCompiler(fc *FunctionCompiler, ftype FunctionType) {
+	fc.enclosing = c.current
+	fc.function = chunk.NewFunction(c.heap)
+	fc.ftype = ftype
+	c.current = fc
+	if ftype != TYPE_SCRIPT {
+		c.current.function.Name = chunk.CopyString(c.heap, c.prev.lexeme)
+	}
+
+	// Slot zero holds the function being called and cannot be named by the user.
+	// In methods it holds the receiver, which is named 'this'.
+	local := &c.current.locals[c.current.localCount]
+	c.current.localCount++
+	local.depth = 0
+	local.isCaptured = false
+	if ftype != TYPE_FUNCTION && ftype != TYPE_SCRIPT {
+		local.name.lexeme = []byte("this")
+	} else {
+		local.name.lexeme = []byte("")
+	}
+}
+
+func (c *Compiler) endCompiler() *chunk.ObjFunction {
+	c.emitReturn()
+	function := c.current.function
+
+	if c.debug != nil && !c.hadError {
+		name := "<script>"
+		if function.Name != nil {
+			name = string(function.Name.Bytes)
+		}
+		c.currentChunk().Disassemble(c.debug, name)
 	}
+
+	c.current = c.current.enclosing
+	return function
 }
 
-func binary() {
-	opKind := p.prev.kind
-	rule := &rules[opKind]
-	parsePrecedence(rule.prec + 1)
+func (c *Compiler) binary(left ast.Expr, canAssign bool) ast.Expr {
+	operator := c.prev
+	rule := &c.rules[operator.kind]
+	right := c.parsePrecedence(rule.prec + 1)
+	c.emitBinaryOp(operator)
+	if !c.tree {
+		return nil
+	}
+	return &ast.BinaryExpr{X: left, OpPos: operator.position(), Op: string(operator.lexeme), Y: right}
+}
 
-	switch opKind {
+// The right operand is on top of the left operand on the stack.
+func (c *Compiler) emitBinaryOp(operator *Token) {
+	switch operator.kind {
 	case T_BANG_EQUAL:
-		emitBytes(byte(chunk.OP_EQUAL), byte(chunk.OP_NOT))
+		c.emitBytesAt(operator, byte(chunk.OP_EQUAL), byte(chunk.OP_NOT))
 	case T_EQUAL_EQUAL:
-		emitByte(byte(chunk.OP_EQUAL))
+		c.emitByteAt(operator, byte(chunk.OP_EQUAL))
 	case T_GREATER:
-		emitByte(byte(chunk.OP_GREATER))
+		c.emitByteAt(operator, byte(chunk.OP_GREATER))
 	case T_GREATER_EQUAL:
-		emitBytes(byte(chunk.OP_LESS), byte(chunk.OP_NOT))
+		c.emitBytesAt(operator, byte(chunk.OP_LESS), byte(chunk.OP_NOT))
 	case T_LESS:
-		emitByte(byte(chunk.OP_LESS))
+		c.emitByteAt(operator, byte(chunk.OP_LESS))
 	case T_LESS_EQUAL:
-		emitBytes(byte(chunk.OP_GREATER), byte(chunk.OP_NOT))
+		c.emitBytesAt(operator, byte(chunk.OP_GREATER), byte(chunk.OP_NOT))
 	case T_PLUS:
-		emitByte(byte(chunk.OP_ADD))
+		c.emitByteAt(operator, byte(chunk.OP_ADD))
 	case T_MINUS:
-		emitByte(byte(chunk.OP_SUBTRACT))
+		c.emitByteAt(operator, byte(chunk.OP_SUBTRACT))
 	case T_STAR:
-		emitByte(byte(chunk.OP_MULTIPLY))
+		c.emitByteAt(operator, byte(chunk.OP_MULTIPLY))
 	case T_SLASH:
-		emitByte(byte(chunk.OP_DIVIDE))
+		c.emitByteAt(operator, byte(chunk.OP_DIVIDE))
 	default:
 		panic("Invalid binary operator token kind.")
+	}
+}
+
+// The left operand is on the stack, skip the right operand if it is falsey.
+func (c *Compiler) and_(left ast.Expr, canAssign bool) ast.Expr {
+	operator := c.prev
+	endJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+
+	c.emitByte(byte(chunk.OP_POP))
+	right := c.parsePrecedence(PREC_AND)
 
+	c.patchJump(endJump)
+	if !c.tree {
+		return nil
+	}
+	return &ast.BinaryExpr{X: left, OpPos: operator.position(), Op: "and", Y: right}
+}
+
+// The left operand is on the stack, skip the right operand if it is truthy.
+func (c *Compiler) or_(left ast.Expr, canAssign bool) ast.Expr {
+	operator := c.prev
+	elseJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+	endJump := c.emitJump(chunk.OP_JUMP)
+
+	c.patchJump(elseJump)
+	c.emitByte(byte(chunk.OP_POP))
+
+	right := c.parsePrecedence(PREC_OR)
+	c.patchJump(endJump)
+	if !c.tree {
+		return nil
+	}
+	return &ast.BinaryExpr{X: left, OpPos: operator.position(), Op: "or", Y: right}
+}
+
+// Compile the arguments after the '(' of a call. The node of the call gets
+// the arguments and the parentheses when the tree is built.
+func (c *Compiler) argumentList(call *ast.CallExpr) byte {
+	lparen := c.prev
+	argCount := 0
+	if !c.check(T_RIGHT_PAREN) {
+		for {
+			arg := c.expression()
+			if c.tree {
+				call.Args = append(call.Args, arg)
+			}
+			if argCount == math.MaxUint8 {
+				c.errorAtPrev("Can't have more than 255 arguments.")
+			}
+			argCount++
+			if !c.match(T_COMMA) {
+				break
+			}
+		}
+	}
+	c.consume(T_RIGHT_PAREN, "Expect ')' after arguments.")
+	if c.tree {
+		call.Lparen = lparen.position()
+		call.Rparen = c.prev.position()
 	}
+	return byte(argCount)
 }
 
-func literal() {
-	switch p.prev.kind {
+// The node of a call, nil unless the tree is built.
+func (c *Compiler) newCall(fun ast.Expr) *ast.CallExpr {
+	if !c.tree {
+		return nil
+	}
+	return &ast.CallExpr{Fun: fun}
+}
+
+func (c *Compiler) call(left ast.Expr, canAssign bool) ast.Expr {
+	paren := c.prev
+	call := c.newCall(left)
+	argCount := c.argumentList(call)
+	c.emitBytesAt(paren, byte(chunk.OP_CALL), argCount)
+	if !c.tree {
+		return nil
+	}
+	return call
+}
+
+func (c *Compiler) dot(left ast.Expr, canAssign bool) ast.Expr {
+	c.consume(T_IDENTIFIER, "Expect property name after '.'.")
+	property := c.prev
+	name := c.identifierConstant(property)
+
+	var get *ast.GetExpr
+	if c.tree {
+		get = &ast.GetExpr{X: left, Name: property.ident()}
+	}
+	if canAssign && c.match(T_EQUAL) {
+		value := c.expression()
+		c.emitBytesAt(property, byte(chunk.OP_SET_PROPERTY), name)
+		if !c.tree {
+			return nil
+		}
+		return &ast.SetExpr{X: left, Name: get.Name, Value: value}
+	} else if c.match(T_LEFT_PAREN) {
+		// Call the method directly without creating a bound method.
+		call := c.newCall(get)
+		argCount := c.argumentList(call)
+		c.emitBytesAt(property, byte(chunk.OP_INVOKE), name)
+		c.emitByteAt(property, argCount)
+		if !c.tree {
+			return nil
+		}
+		return call
+	}
+	c.emitBytesAt(property, byte(chunk.OP_GET_PROPERTY), name)
+	if !c.tree {
+		return nil
+	}
+	return get
+}
+
+func (c *Compiler) literal(canAssign bool) ast.Expr {
+	pos := c.prev.position()
+	switch c.prev.kind {
 	case T_FALSE:
-		emitByte(byte(chunk.OP_FALSE))
+		c.emitByte(byte(chunk.OP_FALSE))
+		if c.tree {
+			return &ast.BoolLit{ValuePos: pos, Value: false}
+		}
 	case T_NIL:
-		emitByte(byte(chunk.OP_NIL))
+		c.emitByte(byte(chunk.OP_NIL))
+		if c.tree {
+			return &ast.NilLit{ValuePos: pos}
+		}
 	case T_TRUE:
-		emitByte(byte(chunk.OP_TRUE))
+		c.emitByte(byte(chunk.OP_TRUE))
+		if c.tree {
+			return &ast.BoolLit{ValuePos: pos, Value: true}
+		}
 	default:
 		panic("Invalid token to create 'push literal' opcode.")
 	}
+	return nil
 }
 
-func grouping() {
-	expression()
-	consume(T_RIGHT_PAREN, "Expect ')' after expression.")
+func (c *Compiler) grouping(canAssign bool) ast.Expr {
+	lparen := c.prev
+	x := c.expression()
+	c.consume(T_RIGHT_PAREN, "Expect ')' after expression.")
+	if !c.tree {
+		return nil
+	}
+	return &ast.ParenExpr{Lparen: lparen.position(), X: x, Rparen: c.prev.position()}
 }
 
-func makeConstant(x chunk.Value) byte {
-	b := currentChunk().AddConstant(x)
+func (c *Compiler) makeConstant(x chunk.Value) byte {
+	b := c.currentChunk().AddConstant(x)
 	if b > math.MaxInt8 {
-		errorAtPrev("Too many constants in one chunk.")
+		c.errorAtPrev("Too many constants in one chunk.")
 		return 0
 	} else {
 		return b
 	}
 }
 
-func emitConstant(x chunk.Value) {
-	emitBytes(byte(chunk.OP_CONSTANT), makeConstant(x))
+func (c *Compiler) emitConstant(x chunk.Value) {
+	c.emitBytes(byte(chunk.OP_CONSTANT), c.makeConstant(x))
 }
 
-func number() {
-	x, err := strconv.ParseFloat(string(p.prev.lexeme), 64)
+func (c *Compiler) number(canAssign bool) ast.Expr {
+	x, err := strconv.ParseFloat(string(c.prev.lexeme), 64)
 	if err != nil {
-		panic(fmt.Sprintf("Compiler failed to parse float: %v", err))
+		// The scanner only makes valid numbers, a rewritten tree may not.
+		c.errorAtPrev("Invalid number.")
+	}
+	c.emitConstant(chunk.NewNumber(chunk.Number(x)))
+	if !c.tree {
+		return nil
+	}
+	return &ast.NumberLit{ValuePos: c.prev.position(), Value: string(c.prev.lexeme)}
+}
+
+func (c *Compiler) pstring(canAssign bool) ast.Expr {
+	n := len(c.prev.lexeme)
+	c.emitConstant(chunk.NewObjString(c.heap, c.prev.lexeme[1:n-1]))
+	if !c.tree {
+		return nil
 	}
-	emitConstant(chunk.NewNumber(chunk.Number(x)))
+	return &ast.StringLit{ValuePos: c.prev.position(), Value: string(c.prev.lexeme[1 : n-1])}
 }
 
-func pstring() {
-	n := len(p.prev.lexeme)
-	obj := chunk.CopyString(p.prev.lexeme[1 : n-1])
-	emitConstant(chunk.NewObj((*chunk.Obj)(unsafe.Pointer(&obj))))
+// A token for a name the compiler declares itself, such as 'super'.
+func (c *Compiler) syntheticToken(text string) Token {
+	return Token{kind: T_IDENTIFIER, lexeme: []byte(text), line: c.prev.line, column: c.prev.column, start: c.prev.start, end: c.prev.end}
+}
+
+func (c *Compiler) super_(canAssign bool) ast.Expr {
+	keyword := c.prev
+	if c.currentClass == nil {
+		c.errorAtPrev("Can't use 'super' outside of a class.")
+	} else if !c.currentClass.hasSuperclass {
+		c.errorAtPrev("Can't use 'super' in a class with no superclass.")
+	}
+
+	c.consume(T_DOT, "Expect '.' after 'super'.")
+	c.consume(T_IDENTIFIER, "Expect superclass method name.")
+	method := c.prev
+	name := c.identifierConstant(method)
+
+	var super_ *ast.SuperExpr
+	if c.tree {
+		super_ = &ast.SuperExpr{Keyword: keyword.position(), Method: method.ident()}
+	}
+	this := c.syntheticToken("this")
+	super := c.syntheticToken("super")
+	c.namedVariable(&this, false)
+	if c.match(T_LEFT_PAREN) {
+		call := c.newCall(super_)
+		argCount := c.argumentList(call)
+		c.namedVariable(&super, false)
+		c.emitBytesAt(method, byte(chunk.OP_SUPER_INVOKE), name)
+		c.emitByteAt(method, argCount)
+		if !c.tree {
+			return nil
+		}
+		return call
+	}
+	c.namedVariable(&super, false)
+	c.emitBytesAt(method, byte(chunk.OP_GET_SUPER), name)
+	if !c.tree {
+		return nil
+	}
+	return super_
 }
 
-func unary() {
-	tKind := p.prev.kind
+func (c *Compiler) this_(canAssign bool) ast.Expr {
+	keyword := c.prev
+	if c.currentClass == nil {
+		c.errorAtPrev("Can't use 'this' outside of a class.")
+	} else {
+		// 'this' is a local variable that cannot be assigned.
+		c.variable(false)
+	}
+	if !c.tree {
+		return nil
+	}
+	return &ast.ThisExpr{Keyword: keyword.position()}
+}
 
-	parsePrecedence(PREC_UNARY)
+func (c *Compiler) unary(canAssign bool) ast.Expr {
+	operator := c.prev
+	x := c.parsePrecedence(PREC_UNARY)
+	c.emitUnaryOp(operator)
+	if !c.tree {
+		return nil
+	}
+	return &ast.UnaryExpr{OpPos: operator.position(), Op: string(operator.lexeme), X: x}
+}
 
-	switch tKind {
+func (c *Compiler) emitUnaryOp(operator *Token) {
+	switch operator.kind {
 	case T_BANG:
-		emitByte(byte(chunk.OP_NOT))
+		c.emitByteAt(operator, byte(chunk.OP_NOT))
 	case T_MINUS:
-		emitByte(byte(chunk.OP_NEGATE))
+		c.emitByteAt(operator, byte(chunk.OP_NEGATE))
 	default:
 		panic("Invalid unary operator token kind.")
 	}
 }
 
-func makeRules() {
-	rules = [T_NUM_TOKENS]ParseRule{
-		T_LEFT_PAREN:    {grouping, nil, PREC_NONE},
+// The parse functions are method values bound to c.
+func (c *Compiler) makeRules() {
+	c.rules = [T_NUM_TOKENS]ParseRule{
+		T_LEFT_PAREN:    {c.grouping, c.call, PREC_CALL},
 		T_RIGHT_PAREN:   {nil, nil, PREC_NONE},
 		T_LEFT_BRACE:    {nil, nil, PREC_NONE},
 		T_RIGHT_BRACE:   {nil, nil, PREC_NONE},
 		T_COMMA:         {nil, nil, PREC_NONE},
-		T_DOT:           {nil, nil, PREC_NONE},
-		T_MINUS:         {unary, binary, PREC_TERM},
-		T_PLUS:          {nil, binary, PREC_TERM},
+		T_DOT:           {nil, c.dot, PREC_CALL},
+		T_MINUS:         {c.unary, c.binary, PREC_TERM},
+		T_PLUS:          {nil, c.binary, PREC_TERM},
 		T_SEMICOLON:     {nil, nil, PREC_NONE},
-		T_SLASH:         {nil, binary, PREC_FACTOR},
-		T_STAR:          {nil, binary, PREC_FACTOR},
-		T_BANG:          {unary, nil, PREC_NONE},
-		T_BANG_EQUAL:    {nil, binary, PREC_EQUALITY},
+		T_SLASH:         {nil, c.binary, PREC_FACTOR},
+		T_STAR:          {nil, c.binary, PREC_FACTOR},
+		T_BANG:          {c.unary, nil, PREC_NONE},
+		T_BANG_EQUAL:    {nil, c.binary, PREC_EQUALITY},
 		T_EQUAL:         {nil, nil, PREC_NONE},
-		T_EQUAL_EQUAL:   {nil, binary, PREC_EQUALITY},
-		T_GREATER:       {nil, binary, PREC_COMPARISON},
-		T_GREATER_EQUAL: {nil, binary, PREC_COMPARISON},
-		T_LESS:          {nil, binary, PREC_COMPARISON},
-		T_LESS_EQUAL:    {nil, binary, PREC_COMPARISON},
-		T_IDENTIFIER:    {nil, nil, PREC_NONE},
-		T_STRING:        {pstring, nil, PREC_NONE},
-		T_NUMBER:        {number, nil, PREC_NONE},
-		T_AND:           {nil, nil, PREC_NONE},
+		T_EQUAL_EQUAL:   {nil, c.binary, PREC_EQUALITY},
+		T_GREATER:       {nil, c.binary, PREC_COMPARISON},
+		T_GREATER_EQUAL: {nil, c.binary, PREC_COMPARISON},
+		T_LESS:          {nil, c.binary, PREC_COMPARISON},
+		T_LESS_EQUAL:    {nil, c.binary, PREC_COMPARISON},
+		T_IDENTIFIER:    {c.variable, nil, PREC_NONE},
+		T_STRING:        {c.pstring, nil, PREC_NONE},
+		T_NUMBER:        {c.number, nil, PREC_NONE},
+		T_AND:           {nil, c.and_, PREC_AND},
 		T_CLASS:         {nil, nil, PREC_NONE},
 		T_ELSE:          {nil, nil, PREC_NONE},
-		T_FALSE:         {literal, nil, PREC_NONE},
+		T_FALSE:         {c.literal, nil, PREC_NONE},
 		T_FOR:           {nil, nil, PREC_NONE},
 		T_FUN:           {nil, nil, PREC_NONE},
 		T_IF:            {nil, nil, PREC_NONE},
-		T_NIL:           {literal, nil, PREC_NONE},
-		T_OR:            {nil, nil, PREC_NONE},
+		T_NIL:           {c.literal, nil, PREC_NONE},
+		T_OR:            {nil, c.or_, PREC_OR},
 		T_PRINT:         {nil, nil, PREC_NONE},
 		T_RETURN:        {nil, nil, PREC_NONE},
-		T_SUPER:         {nil, nil, PREC_NONE},
-		T_THIS:          {nil, nil, PREC_NONE},
-		T_TRUE:          {literal, nil, PREC_NONE},
+		T_SUPER:         {c.super_, nil, PREC_NONE},
+		T_THIS:          {c.this_, nil, PREC_NONE},
+		T_TRUE:          {c.literal, nil, PREC_NONE},
 		T_VAR:           {nil, nil, PREC_NONE},
 		T_WHILE:         {nil, nil, PREC_NONE},
 		T_ERROR:         {nil, nil, PREC_NONE},
@@ -263,49 +675,723 @@ func makeRules() {
 	}
 }
 
-func parsePrecedence(prec Precedence) {
-	advance()
+func (c *Compiler) parsePrecedence(prec Precedence) ast.Expr {
+	c.advance()
 	// TODO: &rules[], (&rules[]), or just rules?
-	prefixRule := rules[p.prev.kind].prefix
+	prefixRule := c.rules[c.prev.kind].prefix
 	if prefixRule == nil {
-		errorAtPrev("Expect expression.")
+		c.errorAtPrev("Expect expression.")
+		if !c.tree {
+			return nil
+		}
+		return &ast.BadExpr{From: c.prev.position()}
+	}
+
+	canAssign := prec <= PREC_ASSIGNMENT
+	expr := prefixRule(canAssign)
+
+	for prec <= c.rules[c.curr.kind].prec {
+		c.advance()
+		infixRule := c.rules[c.prev.kind].infix
+		expr = infixRule(expr, canAssign)
+	}
+
+	// Nothing consumed the '=', so the left-hand side was not assignable.
+	if canAssign && c.match(T_EQUAL) {
+		c.errorAtPrev("Invalid assignment target.")
+	}
+	return expr
+}
+
+// Store the variable name in the constant table, instructions refer to it by index.
+func (c *Compiler) identifierConstant(name *Token) byte {
+	return c.makeConstant(chunk.NewObjString(c.heap, name.lexeme))
+}
+
+func identifiersEqual(a, b *Token) bool {
+	return bytes.Equal(a.lexeme, b.lexeme)
+}
+
+// Find the stack slot of a local variable, or -1 if it is not a local and
+// should be looked up as a global.
+func (c *Compiler) resolveLocal(fc *FunctionCompiler, name *Token) int {
+	// Walk backwards so inner variables shadow outer ones.
+	for i := fc.localCount - 1; i >= 0; i-- {
+		local := &fc.locals[i]
+		if identifiersEqual(name, &local.name) {
+			if local.depth == -1 {
+				c.errorAtPrev("Can't read local variable in its own initializer.")
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Compiler) addUpvalue(fc *FunctionCompiler, index uint8, isLocal bool) int {
+	upvalueCount := fc.function.UpvalueCount
+
+	// A closure captures each variable only once.
+	for i := 0; i < upvalueCount; i++ {
+		upvalue := &fc.upvalues[i]
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if upvalueCount == UINT8_COUNT {
+		c.errorAtPrev("Too many closure variables in function.")
+		return 0
+	}
+
+	fc.upvalues[upvalueCount].isLocal = isLocal
+	fc.upvalues[upvalueCount].index = index
+	fc.function.UpvalueCount++
+	return upvalueCount
+}
+
+// Find the upvalue index of a variable declared in an enclosing function,
+// or -1 if it should be looked up as a global. Each function in between
+// captures the variable too, so it is passed down one level at a time.
+func (c *Compiler) resolveUpvalue(fc *FunctionCompiler, name *Token) int {
+	if fc.enclosing == nil {
+		return -1
+	}
+
+	local := c.resolveLocal(fc.enclosing, name)
+	if local != -1 {
+		fc.enclosing.locals[local].isCaptured = true
+		return c.addUpvalue(fc, uint8(local), true)
+	}
+
+	upvalue := c.resolveUpvalue(fc.enclosing, name)
+	if upvalue != -1 {
+		return c.addUpvalue(fc, uint8(upvalue), false)
+	}
+
+	return -1
+}
+
+func (c *Compiler) addLocal(name Token) {
+	if c.current.localCount == UINT8_COUNT {
+		c.errorAtPrev("Too many local variables in function.")
+		return
+	}
+	local := &c.current.locals[c.current.localCount]
+	c.current.localCount++
+	local.name = name
+	local.depth = -1
+	local.isCaptured = false
+}
+
+func (c *Compiler) declareVariable() {
+	if c.current.scopeDepth == 0 {
+		return
+	}
+
+	name := c.prev
+	for i := c.current.localCount - 1; i >= 0; i-- {
+		local := &c.current.locals[i]
+		if local.depth != -1 && local.depth < c.current.scopeDepth {
+			break
+		}
+		if identifiersEqual(name, &local.name) {
+			c.errorAtPrev("Already a variable with this name in this scope.")
+		}
+	}
+	c.addLocal(*name)
+}
+
+func (c *Compiler) parseVariable(errMsg string) byte {
+	c.consume(T_IDENTIFIER, errMsg)
+	return c.declareName()
+}
+
+// Declare the variable named by the previous token. Returns the constant
+// with its name for a global, see parseVariable.
+func (c *Compiler) declareName() byte {
+	c.declareVariable()
+	if c.current.scopeDepth > 0 {
+		// Locals are not looked up by name at runtime.
+		return 0
+	}
+
+	return c.identifierConstant(c.prev)
+}
+
+func (c *Compiler) markInitialized() {
+	if c.current.scopeDepth == 0 {
 		return
 	}
+	c.current.locals[c.current.localCount-1].depth = c.current.scopeDepth
+}
+
+func (c *Compiler) defineVariable(global byte) {
+	if c.current.scopeDepth > 0 {
+		// The value is already on top of the stack, in the local's slot.
+		c.markInitialized()
+		return
+	}
+	c.emitBytes(byte(chunk.OP_DEFINE_GLOBAL), global)
+}
 
-	prefixRule()
+func (c *Compiler) namedVariable(name *Token, canAssign bool) ast.Expr {
+	getOp, setOp, arg := c.resolveVariable(name)
 
-	for prec <= rules[p.curr.kind].prec {
-		advance()
-		infixRule := rules[p.prev.kind].infix
-		infixRule()
+	if canAssign && c.match(T_EQUAL) {
+		value := c.expression()
+		c.emitBytesAt(name, byte(setOp), byte(arg))
+		if !c.tree {
+			return nil
+		}
+		return &ast.AssignExpr{Name: name.ident(), Value: value}
+	}
+	c.emitBytesAt(name, byte(getOp), byte(arg))
+	if !c.tree {
+		return nil
 	}
+	return name.ident()
 }
 
-func expression() {
-	parsePrecedence(PREC_ASSIGNMENT)
+// The instructions and their operand to read and assign the variable.
+func (c *Compiler) resolveVariable(name *Token) (getOp, setOp chunk.OpCode, arg int) {
+	arg = c.resolveLocal(c.current, name)
+	if arg != -1 {
+		getOp = chunk.OP_GET_LOCAL
+		setOp = chunk.OP_SET_LOCAL
+	} else if arg = c.resolveUpvalue(c.current, name); arg != -1 {
+		getOp = chunk.OP_GET_UPVALUE
+		setOp = chunk.OP_SET_UPVALUE
+	} else {
+		arg = int(c.identifierConstant(name))
+		getOp = chunk.OP_GET_GLOBAL
+		setOp = chunk.OP_SET_GLOBAL
+	}
+	return getOp, setOp, arg
 }
 
-func Compile(source []uint8, c *chunk.Chunk) bool {
-	fmt.Printf("compiling code: %s\n", source)
-	makeRules()
+func (c *Compiler) variable(canAssign bool) ast.Expr {
+	return c.namedVariable(c.prev, canAssign)
+}
+
+func (c *Compiler) expression() ast.Expr {
+	return c.parsePrecedence(PREC_ASSIGNMENT)
+}
+
+func (c *Compiler) beginScope() {
+	c.current.scopeDepth++
+}
+
+func (c *Compiler) endScope() {
+	c.current.scopeDepth--
+
+	// Pop the locals that go out of scope.
+	for c.current.localCount > 0 && c.current.locals[c.current.localCount-1].depth > c.current.scopeDepth {
+		if c.current.locals[c.current.localCount-1].isCaptured {
+			c.emitByte(byte(chunk.OP_CLOSE_UPVALUE))
+		} else {
+			c.emitByte(byte(chunk.OP_POP))
+		}
+		c.current.localCount--
+	}
+}
+
+// The '{' is consumed by the caller.
+func (c *Compiler) block() *ast.BlockStmt {
+	var block *ast.BlockStmt
+	if c.tree {
+		block = &ast.BlockStmt{Lbrace: c.prev.position()}
+	}
+	for !c.check(T_RIGHT_BRACE) && !c.check(T_EOF) {
+		decl := c.declaration(false)
+		if c.tree {
+			block.List = append(block.List, decl)
+		}
+	}
+	c.consume(T_RIGHT_BRACE, "Expect '}' after block.")
+	if c.tree {
+		block.Rbrace = c.prev.position()
+	}
+	return block
+}
+
+func (c *Compiler) printStatement() ast.Stmt {
+	keyword := c.prev
+	x := c.expression()
+	c.consume(T_SEMICOLON, "Expect ';' after value.")
+	c.emitByte(byte(chunk.OP_PRINT))
+	if !c.tree {
+		return nil
+	}
+	return &ast.PrintStmt{Print: keyword.position(), X: x, Semicolon: c.prev.position()}
+}
+
+// An expression followed by a semicolon, evaluated for its side effects.
+// topLevel is set for the declarations of the script itself, the last one
+// returns its value instead, see ReturnLastExpression.
+func (c *Compiler) expressionStatement(topLevel bool) ast.Stmt {
+	x := c.expression()
+	c.consume(T_SEMICOLON, "Expect ';' after expression.")
+	if topLevel && c.returnLast && c.check(T_EOF) {
+		c.emitByte(byte(chunk.OP_RETURN))
+	} else {
+		c.emitByte(byte(chunk.OP_POP))
+	}
+	if !c.tree {
+		return nil
+	}
+	return &ast.ExprStmt{X: x, Semicolon: c.prev.position()}
+}
+
+func (c *Compiler) ifStatement() ast.Stmt {
+	keyword := c.prev
+	c.consume(T_LEFT_PAREN, "Expect '(' after 'if'.")
+	cond := c.expression()
+	c.consume(T_RIGHT_PAREN, "Expect ')' after condition.")
+	rparen := c.prev
+
+	thenJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+	c.emitByte(byte(chunk.OP_POP)) // Pop condition.
+	then := c.statement(false)
+
+	elseJump := c.emitJump(chunk.OP_JUMP)
+
+	c.patchJump(thenJump)
+	c.emitByte(byte(chunk.OP_POP)) // Pop condition.
+
+	var else_ ast.Stmt
+	if c.match(T_ELSE) {
+		else_ = c.statement(false)
+	}
+	c.patchJump(elseJump)
+	if !c.tree {
+		return nil
+	}
+	return &ast.IfStmt{If: keyword.position(), Cond: cond, Rparen: rparen.position(), Then: then, Else: else_}
+}
+
+func (c *Compiler) returnStatement() ast.Stmt {
+	keyword := c.prev
+	if c.current.ftype == TYPE_SCRIPT {
+		c.errorAtPrev("Can't return from top-level code.")
+	}
+
+	var result ast.Expr
+	if c.match(T_SEMICOLON) {
+		c.emitReturn()
+	} else {
+		if c.current.ftype == TYPE_INITIALIZER {
+			c.errorAtPrev("Can't return a value from an initializer.")
+		}
+		result = c.expression()
+		c.consume(T_SEMICOLON, "Expect ';' after return value.")
+		c.emitByte(byte(chunk.OP_RETURN))
+	}
+	if !c.tree {
+		return nil
+	}
+	return &ast.ReturnStmt{Return: keyword.position(), Result: result, Semicolon: c.prev.position()}
+}
+
+func (c *Compiler) whileStatement() ast.Stmt {
+	keyword := c.prev
+	loopStart := len(c.currentChunk().Code)
+	c.consume(T_LEFT_PAREN, "Expect '(' after 'while'.")
+	cond := c.expression()
+	c.consume(T_RIGHT_PAREN, "Expect ')' after condition.")
+	rparen := c.prev
+
+	exitJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+	c.emitByte(byte(chunk.OP_POP))
+	body := c.statement(false)
+	c.emitLoop(loopStart)
+
+	c.patchJump(exitJump)
+	c.emitByte(byte(chunk.OP_POP))
+	if !c.tree {
+		return nil
+	}
+	return &ast.WhileStmt{While: keyword.position(), Cond: cond, Rparen: rparen.position(), Body: body}
+}
+
+// All three clauses are optional. The increment clause is compiled before the
+// body, so the body jumps back to it and it loops back to the condition.
+func (c *Compiler) forStatement() ast.Stmt {
+	keyword := c.prev
+	var init ast.Stmt
+	var cond, post ast.Expr
+	c.beginScope()
+	c.consume(T_LEFT_PAREN, "Expect '(' after 'for'.")
+	if c.match(T_SEMICOLON) {
+		// No initializer.
+	} else if c.match(T_VAR) {
+		init = c.varDeclaration()
+	} else {
+		init = c.expressionStatement(false)
+	}
+
+	loopStart := len(c.currentChunk().Code)
+	exitJump := -1
+	if !c.match(T_SEMICOLON) {
+		cond = c.expression()
+		c.consume(T_SEMICOLON, "Expect ';' after loop condition.")
+
+		// Jump out of the loop if the condition is false.
+		exitJump = c.emitJump(chunk.OP_JUMP_IF_FALSE)
+		c.emitByte(byte(chunk.OP_POP)) // Pop condition.
+	}
+	semicolon := c.prev
+
+	if !c.match(T_RIGHT_PAREN) {
+		bodyJump := c.emitJump(chunk.OP_JUMP)
+		incrementStart := len(c.currentChunk().Code)
+		post = c.expression()
+		c.emitByte(byte(chunk.OP_POP))
+		c.consume(T_RIGHT_PAREN, "Expect ')' after for clauses.")
+
+		c.emitLoop(loopStart)
+		loopStart = incrementStart
+		c.patchJump(bodyJump)
+	}
+	rparen := c.prev
+
+	body := c.statement(false)
+	c.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		c.patchJump(exitJump)
+		c.emitByte(byte(chunk.OP_POP)) // Pop condition.
+	}
+
+	c.endScope()
+	if !c.tree {
+		return nil
+	}
+	return &ast.ForStmt{
+		For:       keyword.position(),
+		Init:      init,
+		Cond:      cond,
+		Semicolon: semicolon.position(),
+		Post:      post,
+		Rparen:    rparen.position(),
+		Body:      body,
+	}
+}
+
+func (c *Compiler) statement(topLevel bool) ast.Stmt {
+	if c.match(T_PRINT) {
+		return c.printStatement()
+	} else if c.match(T_FOR) {
+		return c.forStatement()
+	} else if c.match(T_IF) {
+		return c.ifStatement()
+	} else if c.match(T_RETURN) {
+		return c.returnStatement()
+	} else if c.match(T_WHILE) {
+		return c.whileStatement()
+	} else if c.match(T_LEFT_BRACE) {
+		c.beginScope()
+		block := c.block()
+		c.endScope()
+		if !c.tree {
+			return nil
+		}
+		return block
+	} else {
+		return c.expressionStatement(topLevel)
+	}
+}
+
+// Compile the parameters and body of a function and emit it as a constant.
+// The function is named by the previous token, fun is the 'fun' keyword of
+// a function declaration and nil for a method.
+func (c *Compiler) function(ftype FunctionType, fun *Token) *ast.FunDecl {
+	var decl *ast.FunDecl
+	if c.tree {
+		decl = &ast.FunDecl{Name: c.prev.ident()}
+		if fun != nil {
+			decl.Fun = fun.position()
+		}
+	}
+	var fc FunctionCompiler
+	c.initCompiler(&fc, ftype)
+	c.beginScope()
+
+	c.consume(T_LEFT_PAREN, "Expect '(' after function name.")
+	if !c.check(T_RIGHT_PAREN) {
+		for {
+			c.current.function.Arity++
+			if c.current.function.Arity > math.MaxUint8 {
+				c.errorAtCurr("Can't have more than 255 parameters.")
+			}
+			constant := c.parseVariable("Expect parameter name.")
+			if c.tree {
+				decl.Params = append(decl.Params, c.prev.ident())
+			}
+			c.defineVariable(constant)
+			if !c.match(T_COMMA) {
+				break
+			}
+		}
+	}
+	c.consume(T_RIGHT_PAREN, "Expect ')' after parameters.")
+	c.consume(T_LEFT_BRACE, "Expect '{' before function body.")
+	body := c.block()
+	c.endFunction(&fc)
+	if c.tree {
+		decl.Body = body
+	}
+	return decl
+}
+
+// Finish the function compiled by fc and emit the closure that wraps it.
+func (c *Compiler) endFunction(fc *FunctionCompiler) {
+	// No endScope, the frame's slots are discarded on return.
+	function := c.endCompiler()
+	c.emitBytes(byte(chunk.OP_CLOSURE), c.makeConstant(chunk.NewObjFunction(function)))
+
+	// Tell the VM where to capture each upvalue from.
+	for i := 0; i < function.UpvalueCount; i++ {
+		isLocal := byte(0)
+		if fc.upvalues[i].isLocal {
+			isLocal = 1
+		}
+		c.emitBytes(isLocal, fc.upvalues[i].index)
+	}
+}
+
+func (c *Compiler) method() *ast.FunDecl {
+	c.consume(T_IDENTIFIER, "Expect method name.")
+	constant := c.identifierConstant(c.prev)
+
+	ftype := TYPE_METHOD
+	if string(c.prev.lexeme) == "init" {
+		ftype = TYPE_INITIALIZER
+	}
+	decl := c.function(ftype, nil)
+	c.emitBytes(byte(chunk.OP_METHOD), constant)
+	return decl
+}
+
+func (c *Compiler) classDeclaration() ast.Stmt {
+	keyword := c.prev
+	c.consume(T_IDENTIFIER, "Expect class name.")
+	className := c.prev
+	var decl *ast.ClassDecl
+	if c.tree {
+		decl = &ast.ClassDecl{Class: keyword.position(), Name: className.ident()}
+	}
+	nameConstant := c.identifierConstant(c.prev)
+	c.declareVariable()
+
+	c.emitBytes(byte(chunk.OP_CLASS), nameConstant)
+	c.defineVariable(nameConstant)
+
+	classCompiler := ClassCompiler{enclosing: c.currentClass, hasSuperclass: false}
+	c.currentClass = &classCompiler
+
+	if c.match(T_LESS) {
+		c.consume(T_IDENTIFIER, "Expect superclass name.")
+		c.variable(false)
+		if c.tree {
+			decl.Superclass = c.prev.ident()
+		}
+
+		if identifiersEqual(className, c.prev) {
+			c.errorAtPrev("A class can't inherit from itself.")
+		}
+
+		// Store the superclass in a local named 'super', so each class
+		// declaration in the same scope gets its own slot.
+		c.beginScope()
+		c.addLocal(c.syntheticToken("super"))
+		c.defineVariable(0)
+
+		c.namedVariable(className, false)
+		c.emitByte(byte(chunk.OP_INHERIT))
+		classCompiler.hasSuperclass = true
+	}
+
+	// Load the class so the methods can be attached to it.
+	c.namedVariable(className, false)
+	c.consume(T_LEFT_BRACE, "Expect '{' before class body.")
+	if c.tree {
+		decl.Lbrace = c.prev.position()
+	}
+	for !c.check(T_RIGHT_BRACE) && !c.check(T_EOF) {
+		method := c.method()
+		if c.tree {
+			decl.Methods = append(decl.Methods, method)
+		}
+	}
+	c.consume(T_RIGHT_BRACE, "Expect '}' after class body.")
+	c.emitByte(byte(chunk.OP_POP))
+
+	if classCompiler.hasSuperclass {
+		c.endScope()
+	}
+
+	c.currentClass = c.currentClass.enclosing
+	if !c.tree {
+		return nil
+	}
+	decl.Rbrace = c.prev.position()
+	return decl
+}
+
+func (c *Compiler) funDeclaration() ast.Stmt {
+	keyword := c.prev
+	global := c.parseVariable("Expect function name.")
+	// A function may refer to itself in its body.
+	c.markInitialized()
+	decl := c.function(TYPE_FUNCTION, keyword)
+	c.defineVariable(global)
+	if !c.tree {
+		return nil
+	}
+	return decl
+}
+
+func (c *Compiler) varDeclaration() ast.Stmt {
+	keyword := c.prev
+	global := c.parseVariable("Expect variable name.")
+	name := c.prev
+
+	var init ast.Expr
+	if c.match(T_EQUAL) {
+		init = c.expression()
+	} else {
+		c.emitByte(byte(chunk.OP_NIL))
+	}
+	c.consume(T_SEMICOLON, "Expect ';' after variable declaration.")
+
+	c.defineVariable(global)
+	if !c.tree {
+		return nil
+	}
+	return &ast.VarDecl{Var: keyword.position(), Name: name.ident(), Init: init, Semicolon: c.prev.position()}
+}
+
+// topLevel is set for the declarations of the script itself, see
+// expressionStatement.
+func (c *Compiler) declaration(topLevel bool) ast.Stmt {
+	var decl ast.Stmt
+	if c.match(T_CLASS) {
+		decl = c.classDeclaration()
+	} else if c.match(T_FUN) {
+		decl = c.funDeclaration()
+	} else if c.match(T_VAR) {
+		decl = c.varDeclaration()
+	} else {
+		decl = c.statement(topLevel)
+	}
+
+	if c.panicMode {
+		c.synchronize()
+	}
+	return decl
+}
+
+// Skip tokens until the end of the statement with the error, so the next
+// statement is compiled and its errors are reported too.
+func (p *Parser) synchronize() {
+	p.panicMode = false
+
+	for p.curr.kind != T_EOF {
+		if p.prev.kind == T_SEMICOLON {
+			return
+		}
+		switch p.curr.kind {
+		case T_CLASS, T_FUN, T_VAR, T_FOR, T_IF, T_WHILE, T_PRINT, T_RETURN:
+			return
+		}
+		p.advance()
+	}
+}
+
+// Compile the source into the chunk, objects for constants are allocated on heap.
+// If the source has errors the result is an *Error with all diagnostics.
+// The compiled chunk is pinned on heap so its constants survive collections
+// until it runs, see vm.VM.Interpret.
+func Compile(source []uint8, target *chunk.Chunk, heap *chunk.Heap, options ...Option) error {
 	_, tokens := scan([]byte(source))
 
-	p = Parser{
-		curr:           nil,
-		prev:           nil,
-		tokens:         tokens,
-		hadError:       false,
-		panicMode:      false,
-		compilingChunk: c,
+	c := &Compiler{
+		Parser: Parser{
+			tokens: tokens,
+			heap:   heap,
+			source: source,
+		},
+		target: target,
+	}
+	for _, option := range options {
+		option(&c.Parser)
+	}
+	c.makeRules()
+	if c.compile(); c.hadError {
+		return &Error{Diagnostics: c.diagnostics}
+	}
+	return nil
+}
+
+// Parse the source into a syntax tree. The tree is built by the parser of
+// Compile, so it reports the same errors: the result is an *Error with all
+// diagnostics if Compile would fail, and the tree has an *ast.BadExpr
+// wherever an expression is missing.
+func Parse(source []uint8) (*ast.File, error) {
+	_, tokens := scan(source)
+
+	// The bytecode is compiled along with the tree and discarded.
+	target := chunk.MakeChunk()
+	c := &Compiler{
+		Parser: Parser{
+			tokens: tokens,
+			heap:   &chunk.Heap{},
+			source: source,
+		},
+		target: &target,
+		tree:   true,
+	}
+	c.makeRules()
+	if c.compile(); c.hadError {
+		return c.file, &Error{Diagnostics: c.diagnostics}
+	}
+	return c.file, nil
+}
+
+func (c *Compiler) compile() {
+	if c.debug != nil {
+		fmt.Fprintf(c.debug, "compiling code: %s\n", c.source)
 	}
+	c.compileScript(func() {
+		if c.tree {
+			c.file = &ast.File{}
+		}
+		c.advance()
+		for !c.match(T_EOF) {
+			decl := c.declaration(true)
+			if c.tree {
+				c.file.Decls = append(c.file.Decls, decl)
+			}
+		}
+		if c.tree {
+			c.file.EOF = c.prev.position()
+		}
+	})
+}
 
-	// prev_line := -1
+// Compile the top-level script into the target chunk, the declarations are
+// compiled by the given function.
+func (c *Compiler) compileScript(declarations func()) {
+	var script FunctionCompiler
+	c.initCompiler(&script, TYPE_SCRIPT)
+	script.function.Chunk = *c.target
 
-	advance()
-	expression()
-	consume(T_EOF, "Expect end of expression.")
+	declarations()
 
-	endCompiler()
-	// TODO, make this an actual error?
-	return p.hadError
+	function := c.endCompiler()
+	*c.target = function.Chunk
+	if !c.hadError {
+		c.heap.PinChunk(c.target)
+	}
 }
@@ -1,16 +1,350 @@
 package compiler
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/jeroendm/glox/chunk"
 )
 
 func TestSmallExpression(t *testing.T) {
-	chunk := chunk.MakeChunk()
+	c := chunk.MakeChunk()
 	source := "-1;"
-	hasError := Compile([]byte(source), &chunk)
-	if hasError {
-		t.Fatal("failed to compile")
+	if err := Compile([]byte(source), &c, &chunk.Heap{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Compile source and compare the emitted bytes, opcodes and operands alike.
+func assertCode(t *testing.T, source string, expected []chunk.OpCode, options ...Option) {
+	t.Helper()
+	c := chunk.MakeChunk()
+	if err := Compile([]byte(source), &c, &chunk.Heap{}, options...); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Code) != len(expected) {
+		t.Fatalf("expected %d bytes of code, got %d", len(expected), len(c.Code))
+	}
+	for i, b := range expected {
+		if c.Code[i] != uint8(b) {
+			t.Errorf("byte %d: expected %d, got %d", i, b, c.Code[i])
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	assertCode(t, "print 1;\n2;", []chunk.OpCode{
+		chunk.OP_CONSTANT, 0, chunk.OP_PRINT,
+		chunk.OP_CONSTANT, 1, chunk.OP_POP,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	})
+}
+
+func TestMissingSemicolon(t *testing.T) {
+	c := chunk.MakeChunk()
+	if err := Compile([]byte("print 1"), &c, &chunk.Heap{}); err == nil {
+		t.Fatal("expected a compile error")
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	assertCode(t, "var a = 1; a = 2;", []chunk.OpCode{
+		chunk.OP_CONSTANT, 1, chunk.OP_DEFINE_GLOBAL, 0,
+		chunk.OP_CONSTANT, 3, chunk.OP_SET_GLOBAL, 2, chunk.OP_POP,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	})
+}
+
+func TestInvalidAssignmentTarget(t *testing.T) {
+	c := chunk.MakeChunk()
+	if err := Compile([]byte("var a; var b; var c; a * b = c;"), &c, &chunk.Heap{}); err == nil {
+		t.Fatal("expected a compile error")
+	}
+}
+
+func TestLocals(t *testing.T) {
+	assertCode(t, "{ var a = 1; a = 2; }", []chunk.OpCode{
+		chunk.OP_CONSTANT, 0,
+		chunk.OP_CONSTANT, 1, chunk.OP_SET_LOCAL, 1, chunk.OP_POP,
+		chunk.OP_POP,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	})
+}
+
+func TestLocalErrors(t *testing.T) {
+	sources := []string{
+		"{ var a = 1; var a = 2; }",
+		"{ var a = a; }",
+		"{ var a = 1;",
+	}
+	for _, source := range sources {
+		c := chunk.MakeChunk()
+		if err := Compile([]byte(source), &c, &chunk.Heap{}); err == nil {
+			t.Errorf("expected a compile error for %q", source)
+		}
+	}
+}
+
+func TestIfElse(t *testing.T) {
+	assertCode(t, "if (true) 1; else 2;", []chunk.OpCode{
+		chunk.OP_TRUE,
+		chunk.OP_JUMP_IF_FALSE, 0, 7,
+		chunk.OP_POP,
+		chunk.OP_CONSTANT, 0, chunk.OP_POP,
+		chunk.OP_JUMP, 0, 4,
+		chunk.OP_POP,
+		chunk.OP_CONSTANT, 1, chunk.OP_POP,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	})
+}
+
+func TestFunctionErrors(t *testing.T) {
+	sources := []string{
+		"return 1;",
+		"fun f(a, a) {}",
+		"fun f( {}",
+		"f(1, 2;",
+	}
+	for _, source := range sources {
+		c := chunk.MakeChunk()
+		if err := Compile([]byte(source), &c, &chunk.Heap{}); err == nil {
+			t.Errorf("expected a compile error for %q", source)
+		}
+	}
+}
+
+func TestClosure(t *testing.T) {
+	c := chunk.MakeChunk()
+	source := "{ var a = 1; fun f() { return a; } }"
+	if err := Compile([]byte(source), &c, &chunk.Heap{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []chunk.OpCode{
+		chunk.OP_CONSTANT, 0,
+		chunk.OP_CLOSURE, 1, 1, 1, // capture local slot 1
+		chunk.OP_POP,
+		chunk.OP_CLOSE_UPVALUE,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	}
+	for i, b := range expected {
+		if c.Code[i] != uint8(b) {
+			t.Errorf("byte %d: expected %d, got %d", i, b, c.Code[i])
+		}
+	}
+	f := c.Constants[1].AsFunction()
+	if f.UpvalueCount != 1 {
+		t.Errorf("expected 1 upvalue, got %d", f.UpvalueCount)
+	}
+	assertCode(t, "fun f() { var a; fun g() { a = 1; } }", []chunk.OpCode{
+		chunk.OP_CLOSURE, 1, chunk.OP_DEFINE_GLOBAL, 0,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	})
+}
+
+func TestClassErrors(t *testing.T) {
+	sources := []string{
+		"class A { init() { return 1; } }",
+		"print this;",
+		"fun f() { return this; }",
+		"class A { method( }",
+		"class A < A {}",
+		"fun f() { super.method(); }",
+		"class A { method() { super.method(); } }",
+		"class A {} class B < A { method() { super; } }",
+	}
+	for _, source := range sources {
+		c := chunk.MakeChunk()
+		if err := Compile([]byte(source), &c, &chunk.Heap{}); err == nil {
+			t.Errorf("expected a compile error for %q", source)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	inputs := []struct {
+		source   string
+		expected Diagnostic
+		text     string
+	}{
+		{"print 1", Diagnostic{SEVERITY_ERROR, "Expect ';' after value.", T_EOF, "", 1, 8, 7, 7},
+			"[line 1] Error at end: Expect ';' after value."},
+		{"print 1\n  var;", Diagnostic{SEVERITY_ERROR, "Expect ';' after value.", T_VAR, "var", 2, 3, 10, 13},
+			"[line 2] Error at 'var': Expect ';' after value."},
+		{"print \"a\n\tbc", Diagnostic{SEVERITY_ERROR, "Unterminated string.", T_ERROR, "\"a\n\tbc", 1, 7, 6, 12},
+			"[line 1] Error: Unterminated string."},
+	}
+	for _, input := range inputs {
+		c := chunk.MakeChunk()
+		err := Compile([]byte(input.source), &c, &chunk.Heap{})
+		var compileErr *Error
+		if !errors.As(err, &compileErr) {
+			t.Fatalf("expected an *Error for %q, got %v", input.source, err)
+		}
+		if d := compileErr.Diagnostics[0]; d != input.expected {
+			t.Errorf("expected %+v for %q, got %+v", input.expected, input.source, d)
+		}
+		if text := compileErr.Diagnostics[0].String(); text != input.text {
+			t.Errorf("expected %q, got %q", input.text, text)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	c := chunk.MakeChunk()
+	if err := Compile([]byte("print 1 +\n  2;"), &c, &chunk.Heap{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []chunk.Position{
+		{Line: 1, Column: 7, Offset: 6}, {Line: 1, Column: 7, Offset: 6}, // OP_CONSTANT 1
+		{Line: 2, Column: 3, Offset: 12}, {Line: 2, Column: 3, Offset: 12}, // OP_CONSTANT 2
+		{Line: 1, Column: 9, Offset: 8},  // OP_ADD at the '+'
+		{Line: 2, Column: 4, Offset: 13}, // OP_PRINT at the ';'
+	}
+	for i, pos := range expected {
+		if c.Positions[i] != pos {
+			t.Errorf("byte %d: expected position %+v, got %+v", i, pos, c.Positions[i])
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// Each file in testdata/errors has several independent errors, all of them
+// must be reported as listed in the matching .golden file, by Compile and by
+// Parse.
+func TestErrorsGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/errors/*.lox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			source, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := chunk.MakeChunk()
+			err = Compile(source, &c, &chunk.Heap{})
+			var compileErr *Error
+			if !errors.As(err, &compileErr) {
+				t.Fatalf("expected an *Error, got %v", err)
+			}
+			actual := compileErr.Error() + "\n"
+
+			golden := strings.TrimSuffix(file, ".lox") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(actual), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != string(expected) {
+				t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+			}
+			if _, err := Parse(source); err == nil || err.Error()+"\n" != string(expected) {
+				t.Errorf("Parse: expected:\n%s\ngot:\n%v", expected, err)
+			}
+		})
+	}
+}
+
+func TestOutputWriters(t *testing.T) {
+	var debug bytes.Buffer
+	c := chunk.MakeChunk()
+	if err := Compile([]byte("fun f() {} print 1;"), &c, &chunk.Heap{}, Debug(&debug)); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"compiling code: fun f() {} print 1;", "== f ==", "== <script> ==", "OP_PRINT"} {
+		if !strings.Contains(debug.String(), expected) {
+			t.Errorf("expected %q in the debug output:\n%s", expected, debug.String())
+		}
+	}
+}
+
+func TestReturnLastExpression(t *testing.T) {
+	assertCode(t, "1; 2;", []chunk.OpCode{
+		chunk.OP_CONSTANT, 0, chunk.OP_POP,
+		chunk.OP_CONSTANT, 1, chunk.OP_RETURN,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	}, ReturnLastExpression())
+	// Only a trailing expression statement in the script itself.
+	assertCode(t, "{ 1; }", []chunk.OpCode{
+		chunk.OP_CONSTANT, 0, chunk.OP_POP,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	}, ReturnLastExpression())
+	// Not the body of a trailing statement, the loop must keep running.
+	assertCode(t, "while (false) 1;", []chunk.OpCode{
+		chunk.OP_FALSE,
+		chunk.OP_JUMP_IF_FALSE, 0, 7,
+		chunk.OP_POP,
+		chunk.OP_CONSTANT, 0, chunk.OP_POP,
+		chunk.OP_LOOP, 0, 11,
+		chunk.OP_POP,
+		chunk.OP_NIL, chunk.OP_RETURN,
+	}, ReturnLastExpression())
+}
+
+// Disassemble the chunk and the chunks of the functions in its constants.
+func disassembleAll(w *bytes.Buffer, c *chunk.Chunk, name string) {
+	c.Disassemble(w, name)
+	for _, constant := range c.Constants {
+		if constant.IsFunction() {
+			function := constant.AsFunction()
+			disassembleAll(w, &function.Chunk, string(function.Name.Bytes))
+		}
+	}
+}
+
+func TestCompileConcurrently(t *testing.T) {
+	sources := []string{
+		"print 1 + 2 * 3;",
+		"var a = \"a\"; { var b = a; print b; }",
+		"fun f(x) { fun g() { return x; } return g; } print f(1)();",
+		"class A { init(x) { this.x = x; } } class B < A { get() { return super.get; } }",
+		"for (var i = 0; i < 10; i = i + 1) { if (i > 5 and i != 7) print i; else print nil; }",
+		"var x = 1; while (x < 100 or false) x = x * 2;",
+		"print 1 +;",
+	}
+	// The errors and disassembly of the compiled source.
+	compile := func(source string) string {
+		var out bytes.Buffer
+		c := chunk.MakeChunk()
+		if err := Compile([]byte(source), &c, &chunk.Heap{}); err != nil {
+			out.WriteString(err.Error())
+		}
+		disassembleAll(&out, &c, "<script>")
+		return out.String()
+	}
+
+	expected := make([]string, len(sources))
+	for i, source := range sources {
+		expected[i] = compile(source)
+	}
+
+	const n = 500
+	results := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = compile(sources[i%len(sources)])
+		}()
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		if result != expected[i%len(sources)] {
+			t.Fatalf("compiling %q concurrently gave:\n%s\nexpected:\n%s", sources[i%len(sources)], result, expected[i%len(sources)])
+		}
 	}
 }
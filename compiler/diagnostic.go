@@ -0,0 +1,65 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SEVERITY_ERROR Severity = iota
+	SEVERITY_WARNING
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SEVERITY_ERROR:
+		return "Error"
+	case SEVERITY_WARNING:
+		return "Warning"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// A Diagnostic is a problem found in the source, reported at the token
+// where the compiler noticed it.
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+	Kind     TokenKind // T_EOF at the end of the source, T_ERROR when the scanner found the problem
+	Lexeme   string    // source text of the token
+	Line     int
+	Column   int // of the first byte of the token, starting at 1
+	Start    int // byte offset of the token in the source
+	End      int // byte offset just past the token
+}
+
+// Format the diagnostic like clox does, for example
+// "[line 1] Error at 'var': Expect ';' after value.".
+func (d Diagnostic) String() string {
+	where := ""
+	switch d.Kind {
+	case T_EOF:
+		where = " at end"
+	case T_ERROR:
+		// The message describes the token.
+	default:
+		where = fmt.Sprintf(" at '%s'", d.Lexeme)
+	}
+	return fmt.Sprintf("[line %d] %v%s: %s", d.Line, d.Severity, where, d.Message)
+}
+
+// Error is returned by Compile when the source does not compile.
+type Error struct {
+	Diagnostics []Diagnostic
+}
+
+// One diagnostic per line.
+func (e *Error) Error() string {
+	lines := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
@@ -64,18 +64,24 @@ const (
 
 type Token struct {
 	kind   TokenKind
-	lexeme []byte
+	lexeme []byte // the message for T_ERROR tokens
 	line   int
+	column int // of the first byte, starting at 1
+	start  int // byte offset of the token in the source
+	end    int // byte offset just past the token
 }
 
 type stateFn func(*Scanner) stateFn
 
 type Scanner struct {
-	start   int // start of the current token being scanned
-	current int // position of the next position to be scanned
-	line    int
-	source  []byte
-	tokens  chan Token
+	start     int // start of the current token being scanned
+	current   int // position of the next position to be scanned
+	line      int
+	lineStart int // position of the first byte of the current line
+	startLine int // line of start, multi-line strings end on a later line
+	column    int // column of start
+	source    []byte
+	tokens    chan Token
 }
 
 func (s *Scanner) run() {
@@ -97,13 +103,15 @@ func scan(source []byte) (*Scanner, chan Token) {
 }
 
 func scanTopLevel(s *Scanner) stateFn {
+	s.skipWhitespace()
+	s.startLine = s.line
+	s.column = s.start - s.lineStart + 1
+
 	if s.isAtEnd() {
 		s.emit(T_EOF) // Removing this causes an infinite loop in the compiler.
 		return nil
 	}
 
-	s.skipWhitespace()
-
 	c := s.advance()
 
 	// Things I don't know how to put into the switch below
@@ -177,7 +185,10 @@ func scanComment(s *Scanner) stateFn {
 	for s.peek() != '\n' && !s.isAtEnd() {
 		s.advance()
 	}
-	s.advance() // Skip past the '\n'
+	if !s.isAtEnd() {
+		s.advance() // Skip past the '\n'
+		s.newline()
+	}
 	s.discard() // Don't emit a token for the comment's content
 	return scanTopLevel
 }
@@ -185,14 +196,14 @@ func scanComment(s *Scanner) stateFn {
 // Scan (multi-line) string literal and keep track of the line count.
 func scanString(s *Scanner) stateFn {
 	for s.peek() != '"' && !s.isAtEnd() {
-		if s.peek() == '\n' {
-			s.line += 1
+		if s.advance() == '\n' {
+			s.newline()
 		}
-		s.advance()
 	}
 	// peek == '"" or s.isAtEnd
 	if s.isAtEnd() {
-		s.emitError("unterminated string.")
+		s.emitError("Unterminated string.")
+		return scanTopLevel
 	}
 	// peek == '"'
 	s.advance() // Skip past the '"'
@@ -206,7 +217,7 @@ func scanNumber(s *Scanner) stateFn {
 		s.advance()
 	}
 
-	if !s.isAtEnd() && s.peek() == '.' && isDigit(s.source[s.current+1]) {
+	if s.peek() == '.' && isDigit(s.peekNext()) {
 		s.advance()
 		for isDigit(s.peek()) && !s.isAtEnd() {
 			s.advance()
@@ -300,19 +311,26 @@ func (s *Scanner) emitError(message string) {
 }
 
 func (s *Scanner) isAtEnd() bool {
-	return s.current == (len(s.source) - 1)
+	return s.current >= len(s.source)
 }
 
 func (s *Scanner) makeToken(t TokenKind) Token {
-	return Token{t, s.source[s.start:s.current], s.line}
+	return Token{kind: t, lexeme: s.source[s.start:s.current], line: s.startLine, column: s.column, start: s.start, end: s.current}
 }
 
+// The token spans the source that caused the error, such as an unterminated string.
 func (s *Scanner) errorToken(message string) Token {
-	return Token{T_ERROR, []byte(message), s.line}
+	return Token{kind: T_ERROR, lexeme: []byte(message), line: s.startLine, column: s.column, start: s.start, end: s.current}
+}
+
+// Called after advancing past a '\n'.
+func (s *Scanner) newline() {
+	s.line += 1
+	s.lineStart = s.current
 }
 
 func (s *Scanner) advance() byte {
-	if s.current == (len(s.source) - 1) {
+	if s.isAtEnd() {
 		panic("Trying to advance past the end of the source code bytes.")
 	}
 	s.current += 1
@@ -332,10 +350,22 @@ func (s *Scanner) match(expected byte) bool {
 	return true
 }
 
+// Returns zero at the end of the source, which matches none of the characters
+// the scanner is looking for.
 func (s *Scanner) peek() byte {
+	if s.isAtEnd() {
+		return 0
+	}
 	return s.source[s.current]
 }
 
+func (s *Scanner) peekNext() byte {
+	if s.current+1 >= len(s.source) {
+		return 0
+	}
+	return s.source[s.current+1]
+}
+
 func isDigit(c uint8) bool {
 	return '0' <= c && c <= '9'
 }
@@ -344,7 +374,6 @@ func isAlpha(c uint8) bool {
 	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
 }
 
-// Precondition: assumes we are NOT at the end.
 func (s *Scanner) skipWhitespace() {
 	for {
 		c := s.peek()
@@ -352,7 +381,7 @@ func (s *Scanner) skipWhitespace() {
 			s.advance()
 		} else if c == '\n' {
 			s.advance()
-			s.line += 1
+			s.newline()
 		} else {
 			s.discard()
 			return
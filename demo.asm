@@ -10,4 +10,6 @@ add
 constant 2
 divide
 negate
+print
+nil
 return
\ No newline at end of file
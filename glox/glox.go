@@ -0,0 +1,149 @@
+// Package glox embeds the Lox interpreter in Go programs.
+//
+//	interpreter := glox.New(glox.Stdout(&out))
+//	value, err := interpreter.Eval(ctx, "var a = 1; a + 2;")
+package glox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jeroendm/glox/chunk"
+	"github.com/jeroendm/glox/compiler"
+	"github.com/jeroendm/glox/vm"
+)
+
+type Value = chunk.Value
+
+// Interpreter runs Lox source code. Globals defined by one call to Eval are
+// visible to the next. An Interpreter is not safe for concurrent use.
+//
+// Values returned by Eval, Call, NewString and FromGo stay valid while Go code holds
+// them, even when the garbage collector runs in between. Release them when
+// they are no longer needed, so their memory can be reclaimed.
+type Interpreter struct {
+	vm vm.VM
+}
+
+type options struct {
+	vm []vm.Option
+}
+
+// An Option configures an Interpreter when it is made.
+type Option func(*options)
+
+// Write the output of print statements to w instead of os.Stdout.
+func Stdout(w io.Writer) Option {
+	return func(o *options) {
+		o.vm = append(o.vm, vm.Stdout(w))
+	}
+}
+
+// Limit the estimated size of all live objects, see vm.MaxHeapBytes.
+func MaxHeapBytes(n int) Option {
+	return func(o *options) {
+		o.vm = append(o.vm, vm.MaxHeapBytes(n))
+	}
+}
+
+// Limit the number of values on the stack, see vm.MaxStackSize.
+func MaxStackSize(n int) Option {
+	return func(o *options) {
+		o.vm = append(o.vm, vm.MaxStackSize(n))
+	}
+}
+
+// Stop each Eval or Call after n instructions, see vm.InstructionBudget.
+func InstructionBudget(n int64) Option {
+	return func(o *options) {
+		o.vm = append(o.vm, vm.InstructionBudget(n))
+	}
+}
+
+// Stop each Eval or Call that runs longer than d, see vm.Timeout.
+func Timeout(d time.Duration) Option {
+	return func(o *options) {
+		o.vm = append(o.vm, vm.Timeout(d))
+	}
+}
+
+// CompileError is returned by Eval when the source does not compile. Its
+// Diagnostics describe each error with its position in the source.
+type CompileError = compiler.Error
+
+func New(opts ...Option) *Interpreter {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Interpreter{vm: vm.MakeVM(o.vm...)}
+}
+
+// Eval compiles and runs the source. If the last statement is an expression
+// statement its value is returned, otherwise the result is nil.
+// Compile errors are returned as a *CompileError. Runtime errors are
+// returned as a *vm.RuntimeError, also when the script is stopped because
+// ctx is done or a limit is exceeded.
+func (i *Interpreter) Eval(ctx context.Context, source string) (Value, error) {
+	c := chunk.MakeChunk()
+	if err := compiler.Compile([]byte(source), &c, i.vm.Heap(), compiler.ReturnLastExpression()); err != nil {
+		return chunk.NewNil(), err
+	}
+	return i.vm.RunContext(ctx, &c)
+}
+
+// EvalFile is like Eval for the contents of a file.
+func (i *Interpreter) EvalFile(ctx context.Context, filename string) (Value, error) {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		return chunk.NewNil(), err
+	}
+	return i.Eval(ctx, string(source))
+}
+
+func (i *Interpreter) GetGlobal(name string) (Value, bool) {
+	return i.vm.GetGlobal(name)
+}
+
+// Define or assign a global variable. Strings must be made with NewString
+// or FromGo, so they are interned for this interpreter.
+func (i *Interpreter) SetGlobal(name string, value Value) {
+	i.vm.SetGlobal(name, value)
+}
+
+// Make a string value that can be used with this interpreter.
+func (i *Interpreter) NewString(s string) Value {
+	value := chunk.NewObjString(i.vm.Heap(), []byte(s))
+	i.vm.Heap().Pin(value)
+	return value
+}
+
+// Convert a Go value for this interpreter, see chunk.FromGo. Convert
+// values back with chunk.Decode.
+func (i *Interpreter) FromGo(x any) (Value, error) {
+	value, err := chunk.FromGo(i.vm.Heap(), x)
+	if err != nil {
+		return chunk.NewNil(), err
+	}
+	i.vm.Heap().Pin(value)
+	return value, nil
+}
+
+// Release a value returned by Eval, Call, NewString or FromGo. Once it is released,
+// the value is only valid while Lox code refers to it, for example from a
+// global.
+func (i *Interpreter) Release(value Value) {
+	i.vm.Heap().Unpin(value)
+}
+
+// Call the function, native or class stored in a global.
+func (i *Interpreter) Call(fnName string, args ...Value) (Value, error) {
+	callee, ok := i.vm.GetGlobal(fnName)
+	if !ok {
+		return chunk.NewNil(), fmt.Errorf("undefined function '%s'", fnName)
+	}
+	return i.vm.Call(callee, args...)
+}
@@ -0,0 +1,240 @@
+package glox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeroendm/glox/chunk"
+	"github.com/jeroendm/glox/vm"
+)
+
+func TestEval(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	interpreter := New(Stdout(&out))
+
+	value, err := interpreter.Eval(ctx, "var a = 1; print a; a + 2;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsNumber() || value.AsNumber() != 3 {
+		t.Errorf("expected 3, got %v", value)
+	}
+	if out.String() != "1\n" {
+		t.Errorf("expected output %q, got %q", "1\n", out.String())
+	}
+
+	// Globals persist between calls, statements other than expressions return nil.
+	value, err = interpreter.Eval(ctx, "var b = a * 10;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsNil() {
+		t.Errorf("expected nil, got %v", value)
+	}
+	if b, ok := interpreter.GetGlobal("b"); !ok || !b.IsNumber() || b.AsNumber() != 10 {
+		t.Errorf("expected b to be 10")
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	ctx := context.Background()
+	interpreter := New()
+
+	_, err := interpreter.Eval(ctx, "print 1\nvar;")
+	var compileErr *CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("expected a *CompileError, got %v", err)
+	}
+	if len(compileErr.Diagnostics) == 0 || compileErr.Diagnostics[0].String() != "[line 2] Error at 'var': Expect ';' after value." {
+		t.Errorf("unexpected diagnostics %v", compileErr.Diagnostics)
+	}
+	if d := compileErr.Diagnostics[0]; d.Line != 2 || d.Column != 1 || d.Lexeme != "var" {
+		t.Errorf("unexpected position %d:%d of %q", d.Line, d.Column, d.Lexeme)
+	}
+
+	_, err = interpreter.Eval(ctx, "nil();")
+	var runtimeErr *vm.RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected a *vm.RuntimeError, got %v", err)
+	}
+	if runtimeErr.Message != "Can only call functions and classes." {
+		t.Errorf("unexpected message %q", runtimeErr.Message)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = interpreter.Eval(canceled, "1;")
+	if !errors.As(err, &runtimeErr) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a *vm.RuntimeError caused by context.Canceled, got %v", err)
+	}
+}
+
+func TestEvalFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "script.lox")
+	if err := os.WriteFile(filename, []byte("fun square(x) { return x * x; }\nsquare(4);\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	interpreter := New()
+	value, err := interpreter.EvalFile(context.Background(), filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsNumber() || value.AsNumber() != 16 {
+		t.Errorf("expected 16, got %v", value)
+	}
+	if _, err := interpreter.EvalFile(context.Background(), filepath.Join(t.TempDir(), "missing.lox")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestGlobalsAndCall(t *testing.T) {
+	ctx := context.Background()
+	interpreter := New()
+	interpreter.SetGlobal("greeting", interpreter.NewString("hello"))
+	interpreter.SetGlobal("n", chunk.NewNumber(2))
+	source := `
+fun greet(name) { return greeting + " " + name; }
+fun twice(x) { return x * n; }
+class Point { init(x) { this.x = x; } }
+`
+	if _, err := interpreter.Eval(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := interpreter.Call("greet", interpreter.NewString("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsString() || value.AsGoString() != "hello world" {
+		t.Errorf("expected 'hello world', got %v", value)
+	}
+
+	value, err = interpreter.Call("twice", chunk.NewNumber(21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsNumber() || value.AsNumber() != 42 {
+		t.Errorf("expected 42, got %v", value)
+	}
+
+	value, err = interpreter.Call("Point", chunk.NewNumber(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsInstance() {
+		t.Errorf("expected a Point instance, got %v", value)
+	}
+
+	value, err = interpreter.Call("clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsNumber() {
+		t.Errorf("expected clock to return a number, got %v", value)
+	}
+
+	if _, err := interpreter.Call("missing"); err == nil {
+		t.Errorf("expected an error for an undefined function")
+	}
+	if _, err := interpreter.Call("twice"); !errors.Is(err, vm.INTERPRET_RUNTIME_ERROR) {
+		t.Errorf("expected runtime error for a wrong number of arguments, got %v", err)
+	}
+
+	// The interpreter is usable after a failed call.
+	if value, err := interpreter.Eval(ctx, "twice(3);"); err != nil || value.AsNumber() != 6 {
+		t.Errorf("expected 6, got %v, %v", value, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx := context.Background()
+	interpreter := New(InstructionBudget(1000))
+	if _, err := interpreter.Eval(ctx, "var i = 0; while (i < 10) i = i + 1;"); err != nil {
+		t.Fatal(err)
+	}
+	if i, _ := interpreter.GetGlobal("i"); i.AsNumber() != 10 {
+		t.Errorf("expected the loop to run to the end, got i = %v", i)
+	}
+	if _, err := interpreter.Eval(ctx, "while (true) {}"); !errors.Is(err, vm.ErrBudgetExceeded) {
+		t.Errorf("expected ErrBudgetExceeded, got %v", err)
+	}
+
+	interpreter = New(Timeout(10 * time.Millisecond))
+	if _, err := interpreter.Eval(ctx, "while (true) {}"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// Values held by Go code survive collections, their strings stay interned.
+func TestValuesHeldAcrossCollections(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	interpreter := New(Stdout(&out))
+	held, err := interpreter.Eval(ctx, "class P { init() { this.fieldname = 42; } } var p = P(); p;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	greeting := interpreter.NewString("hello")
+
+	collections := interpreter.vm.HeapStats().Collections
+	source := `P = nil; p = nil; var s = ""; for (var i = 0; i < 3000; i = i + 1) s = s + "x";`
+	if _, err := interpreter.Eval(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+	if interpreter.vm.HeapStats().Collections == collections {
+		t.Fatal("expected the garbage collector to run")
+	}
+
+	interpreter.SetGlobal("q", held)
+	interpreter.SetGlobal("greeting", greeting)
+	value, err := interpreter.Eval(ctx, `print greeting == "hello"; q.fieldname;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !value.IsNumber() || value.AsNumber() != 42 {
+		t.Errorf("expected 42, got %v", value)
+	}
+	if out.String() != "true\n" {
+		t.Errorf("expected the string to be interned, got output %q", out.String())
+	}
+	interpreter.Release(held)
+	interpreter.Release(greeting)
+	interpreter.Release(value)
+}
+
+func TestFromGo(t *testing.T) {
+	type Point struct {
+		X, Y  float64
+		Label string `lox:"label"`
+	}
+	interpreter := New()
+	point, err := interpreter.FromGo(Point{X: 1, Y: 2, Label: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	interpreter.SetGlobal("point", point)
+	interpreter.Release(point)
+
+	value, err := interpreter.Eval(context.Background(), `point.label = point.label + "q"; point.X = point.X + point.Y; point;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Point
+	if err := chunk.Decode(value, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != (Point{X: 3, Y: 2, Label: "pq"}) {
+		t.Errorf("expected {3 2 pq}, got %+v", decoded)
+	}
+	interpreter.Release(value)
+
+	if _, err := interpreter.FromGo([]int{1}); err == nil {
+		t.Errorf("expected an error for a slice")
+	}
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/jeroendm/glox/chunk"
-	"github.com/jeroendm/glox/compiler"
+	"github.com/jeroendm/glox/glox"
 	"github.com/jeroendm/glox/vm"
 )
 
@@ -35,7 +39,7 @@ func runFile(filename string) {
 		fmt.Printf("ERROR: %s", e)
 		fmt.Printf("Failed to open file: '%s'\n", filename)
 	}
-	run(content)
+	run(glox.New(), content)
 }
 
 func runByteCode(filename string) {
@@ -47,18 +51,22 @@ func runByteCode(filename string) {
 	}
 	defer file.Close()
 
-	chunk, err := chunk.ParseByteCode(file)
+	vm1 := vm.MakeVM()
+	chunk, err := chunk.ParseByteCode(file, vm1.Heap())
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	chunk.Disassemble(filename)
+	chunk.Disassemble(os.Stdout, filename)
 	fmt.Printf("\n --- running ---\n")
-	vm := vm.MakeVM()
-	vm.InterpretChunk(&chunk)
+	if err := vm1.InterpretChunk(&chunk); err != nil {
+		fmt.Fprint(os.Stderr, vm.Format(err))
+	}
 }
 
 func runPrompt() {
+	// Share one interpreter between lines so globals are remembered.
+	interpreter := glox.New()
 	input := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("> ")
@@ -69,21 +77,42 @@ func runPrompt() {
 		if text == "\n" {
 			break
 		}
-		run([]uint8(text))
+		run(interpreter, []uint8(text))
 	}
 }
 
-func run(source []uint8) {
-	c := chunk.MakeChunk()
+func run(interpreter *glox.Interpreter, source []uint8) {
+	value, err := interpreter.Eval(context.Background(), string(source))
+	if err != nil {
+		report(source, err)
+	}
+	interpreter.Release(value)
+}
 
-	hadError := compiler.Compile(source, &c)
-	if hadError {
-		panic("Failed to compile.")
+// Print compile errors with the line of source they point at, other errors
+// the way the VM formats them.
+func report(source []uint8, err error) {
+	var compileErr *glox.CompileError
+	if !errors.As(err, &compileErr) {
+		fmt.Fprint(os.Stderr, vm.Format(err))
+		return
 	}
+	for _, d := range compileErr.Diagnostics {
+		fmt.Fprintln(os.Stderr, d)
 
-	vm1 := vm.MakeVM()
-	err := vm1.Interpret(&c)
-	if err != nil {
-		panic("Runtime error.")
+		lineStart := d.Start - (d.Column - 1)
+		lineEnd := lineStart + bytes.IndexByte(source[lineStart:], '\n')
+		if lineEnd < lineStart {
+			lineEnd = len(source)
+		}
+		// Keep tabs in the indentation, so the markers line up with the source.
+		indent := bytes.Map(func(r rune) rune {
+			if r == '\t' {
+				return r
+			}
+			return ' '
+		}, source[lineStart:d.Start])
+		markers := strings.Repeat("^", max(min(d.End, lineEnd)-d.Start, 1))
+		fmt.Fprintf(os.Stderr, "    %s\n    %s%s\n", source[lineStart:lineEnd], indent, markers)
 	}
 }
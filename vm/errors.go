@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jeroendm/glox/chunk"
+)
+
+// One call on the Lox stack at the time of a runtime error.
+type StackFrame struct {
+	Function string // empty for the top-level script
+	Line     int
+	Column   int // zero if the chunk has no columns, see chunk.Position
+}
+
+// RuntimeError is returned by Interpret when a script fails. It matches
+// INTERPRET_RUNTIME_ERROR with errors.Is.
+type RuntimeError struct {
+	Message string
+	Line    int          // line of the instruction that failed
+	Column  int          // column of the operator or name the instruction was compiled from
+	OpCode  chunk.OpCode // the instruction that failed
+	Frames  []StackFrame // innermost call first
+	Err     error        // error returned by a native function, if that is the cause
+}
+
+// The message prefixed with the position of the failed instruction, for
+// example "1:7: Operands must be numbers.".
+func (e *RuntimeError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("[line %d] %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+func (e *RuntimeError) Is(target error) bool {
+	return target == INTERPRET_RUNTIME_ERROR
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Format renders an error the way clox reports it: the message followed by
+// a trace with one line per call, innermost first, such as "[line 6:12] in
+// c()". The column is left out for chunks without columns. Errors other than
+// a *RuntimeError are rendered with their Error method.
+func Format(err error) string {
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		return err.Error() + "\n"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", runtimeErr.Message)
+	for _, frame := range runtimeErr.Frames {
+		fmt.Fprintf(&b, "[line %v] in ", chunk.Position{Line: frame.Line, Column: frame.Column})
+		if frame.Function == "" {
+			fmt.Fprintf(&b, "script\n")
+		} else {
+			fmt.Fprintf(&b, "%s()\n", frame.Function)
+		}
+	}
+	return b.String()
+}
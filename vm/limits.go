@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// The context is checked for cancellation once per this many instructions.
+const CHECK_INTERVAL = 1024
+
+// The cause of the runtime error when a script runs more instructions than
+// its budget allows.
+var ErrBudgetExceeded = errors.New("instruction budget exceeded")
+
+// Stop each call to Interpret, Run or Call after n instructions with an
+// ErrBudgetExceeded runtime error. Zero means no limit.
+func InstructionBudget(n int64) Option {
+	return func(vm *VM) {
+		vm.budget = n
+	}
+}
+
+// Stop each call to Interpret, Run or Call that takes longer than d with a
+// context.DeadlineExceeded runtime error. Zero means no limit.
+func Timeout(d time.Duration) Option {
+	return func(vm *VM) {
+		vm.timeout = d
+	}
+}
+
+// Prepare the limits for a new call into the VM. The returned function
+// releases the context and must be called when the call is done.
+func (vm *VM) startLimits(ctx context.Context) context.CancelFunc {
+	cancel := context.CancelFunc(func() {})
+	if vm.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, vm.timeout)
+	}
+	vm.ctx = ctx
+	vm.executed = 0
+	// Check at the first instruction, the context may be done already.
+	vm.nextCheck = 0
+	return func() {
+		cancel()
+		vm.ctx = nil
+	}
+}
+
+// Called by run when executed reaches nextCheck.
+func (vm *VM) checkLimits() error {
+	if vm.budget > 0 && vm.executed > vm.budget {
+		return vm.stopped(ErrBudgetExceeded)
+	}
+	select {
+	case <-vm.ctx.Done():
+		return vm.stopped(vm.ctx.Err())
+	default:
+	}
+
+	vm.nextCheck = vm.executed + CHECK_INTERVAL
+	if vm.budget > 0 {
+		vm.nextCheck = min(vm.nextCheck, vm.budget+1)
+	}
+	return nil
+}
+
+// A runtime error at the current instruction, caused by err.
+func (vm *VM) stopped(err error) *RuntimeError {
+	runtimeErr := vm.runtimeError("Execution stopped: %s.", err)
+	runtimeErr.Err = err
+	return runtimeErr
+}
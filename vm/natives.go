@@ -0,0 +1,19 @@
+package vm
+
+import (
+	"time"
+
+	"github.com/jeroendm/glox/chunk"
+)
+
+var startTime = time.Now()
+
+// Seconds elapsed since the program started.
+func clockNative(args []chunk.Value) (chunk.Value, error) {
+	return chunk.NewNumber(chunk.Number(time.Since(startTime).Seconds())), nil
+}
+
+// The natives every VM starts with.
+func (vm *VM) defineNatives() {
+	vm.DefineNative("clock", 0, clockNative)
+}
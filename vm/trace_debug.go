@@ -10,12 +10,18 @@ import (
 )
 
 func traceInstruction(vm *VM, offset int) {
-	fmt.Printf("          ")
+	if vm.debug == nil {
+		return
+	}
+	fmt.Fprintf(vm.debug, "          ")
 	for _, value := range vm.stack[:vm.stackTop] {
-		fmt.Printf("[ ")
-		chunk.PrintValue(value)
-		fmt.Printf(" ]")
+		fmt.Fprintf(vm.debug, "[ ")
+		chunk.FprintValue(vm.debug, value)
+		fmt.Fprintf(vm.debug, " ]")
+	}
+	fmt.Fprintf(vm.debug, "\n")
+	// Reading past the end is reported as a runtime error by run.
+	if c := &vm.frame().closure.Function.Chunk; offset >= 0 && offset < len(c.Code) {
+		c.DisassembleInstruction(vm.debug, offset)
 	}
-	fmt.Printf("\n")
-	vm.chunk.DisassembleInstruction(offset)
 }
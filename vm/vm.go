@@ -1,9 +1,13 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"unsafe"
+	"time"
 
 	"github.com/jeroendm/glox/chunk"
 )
@@ -18,7 +22,7 @@ const (
 )
 
 var (
-	LESS    = func(a chunk.Number, b chunk.Number) bool { return a > b }
+	LESS    = func(a chunk.Number, b chunk.Number) bool { return a < b }
 	GREATER = func(a chunk.Number, b chunk.Number) bool { return a > b }
 )
 
@@ -44,54 +48,267 @@ func isFalsey(value chunk.Value) bool {
 	return value.IsNil() || value.IsBool() && !value.AsBool()
 }
 
-// One less than 256, stackTop points to the next empty element,
-// therefore we need 256 as a token to signify that the stack is full,
-// otherwise the uint8 would overflow to zero and it would look like the stack is empty.
-const STACK_MAX = 255
+// Maximum depth of nested function calls.
+const FRAMES_MAX = 64
+
+// The stack starts with room for this many values and doubles when it is
+// full, up to the VM's limit.
+const STACK_INITIAL = 256
+
+// Default limit on the number of values on the stack, enough for every
+// frame to use all of its 256 local slots.
+const STACK_MAX = FRAMES_MAX * 256
+
+// Raised by push, pop and peek when the stack over- or underflows, and by
+// the reads of bytecode operands that are out of range. Turned into a
+// runtime error by Interpret.
+type stackFault string
+
+// A single ongoing function call.
+type CallFrame struct {
+	closure *chunk.ObjClosure
+	ip      int
+	slots   int // index in the VM's stack of the first slot the function can use
+}
 
 type VM struct {
-	chunk    *chunk.Chunk
-	ip       int
-	stack    []chunk.Value
-	stackTop uint8
+	frames       [FRAMES_MAX]CallFrame
+	frameCount   int
+	stack        []chunk.Value
+	stackTop     int // index of the next empty slot
+	stackMax     int
+	globals      chunk.Table
+	heap         chunk.Heap // every object is allocated here, including interned strings
+	initString   *chunk.ObjString
+	openUpvalues *chunk.ObjUpvalue // sorted by stack slot, highest slot first
+	instruction  chunk.OpCode      // the instruction being executed, for error reports
+	stdout       io.Writer         // output of print statements
+	debug        io.Writer         // execution trace in debug builds, nil to disable
+
+	// Execution limits, see limits.go.
+	ctx       context.Context // of the current call into the VM
+	budget    int64
+	timeout   time.Duration
+	executed  int64 // instructions executed by the current call into the VM
+	nextCheck int64 // value of executed at which the limits are checked next
 }
 
-func MakeVM() VM {
-	return VM{nil, 0, make([]chunk.Value, STACK_MAX), 0}
+// An Option configures a VM when it is made.
+type Option func(*VM)
+
+// Write the output of print statements to w instead of os.Stdout.
+func Stdout(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.stdout = w
+	}
+}
+
+// Trace every instruction and the stack to w. Tracing is only compiled in
+// with the debug build tag, other builds ignore w.
+func Debug(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.debug = w
+	}
+}
+
+// Limit the number of values on the stack. Deeper nesting of expressions
+// and calls stops with a "Stack overflow." runtime error. Zero or less
+// keeps the default of STACK_MAX.
+func MaxStackSize(n int) Option {
+	return func(vm *VM) {
+		vm.stackMax = n
+	}
+}
+
+// Limit the estimated size of all live objects. A script that needs more
+// stops with an "Out of memory." runtime error. Zero means no limit.
+func MaxHeapBytes(n int) Option {
+	return func(vm *VM) {
+		vm.heap.MaxBytes = n
+	}
+}
+
+func MakeVM(options ...Option) VM {
+	vm := VM{
+		frameCount: 0,
+		stackTop:   0,
+		stackMax:   STACK_MAX,
+		stdout:     os.Stdout,
+	}
+	for _, option := range options {
+		option(&vm)
+	}
+	if vm.stackMax <= 0 {
+		vm.stackMax = STACK_MAX
+	}
+	vm.stack = make([]chunk.Value, min(STACK_INITIAL, vm.stackMax))
+	// Name of the method that is called when a class is instantiated.
+	vm.initString = chunk.CopyString(&vm.heap, []byte("init"))
+	vm.defineNatives()
+	return vm
+}
+
+// The heap of the VM. Chunks that are interpreted by this VM must be
+// compiled with it, so their strings are interned in the same table and
+// can be compared by pointer.
+func (vm *VM) Heap() *chunk.Heap {
+	return &vm.heap
+}
+
+func (vm *VM) HeapStats() chunk.HeapStats {
+	return vm.heap.Stats()
+}
+
+// Make a Go function available to Lox code as a global.
+// An arity of -1 accepts any number of arguments. An error returned by
+// the function is reported as a runtime error at the calling line.
+func (vm *VM) DefineNative(name string, arity int, function chunk.NativeFn) {
+	key := chunk.CopyString(&vm.heap, []byte(name))
+	vm.globals.Set(key, chunk.NewObjNative(chunk.NewNative(&vm.heap, name, arity, function)))
 }
 
 func (vm *VM) InterpretChunk(chunk *chunk.Chunk) error {
-	vm.chunk = chunk
-	vm.ip = 0
-	return vm.run()
+	return vm.Interpret(chunk)
 }
 
+// Run the chunk as the top-level script.
+//
+// compiler.Compile pins the chunk on the heap of the VM, so the names it
+// refers to stay interned until it runs. Interpret, Run and their context
+// variants unpin it once the script finishes. A chunk that is not run must
+// be unpinned with chunk.Heap.UnpinChunk, and a chunk that is run again must
+// be pinned again with chunk.Heap.PinChunk first.
 func (vm *VM) Interpret(c *chunk.Chunk) error {
-	// c := chunk.MakeChunk()
+	return vm.InterpretContext(context.Background(), c)
+}
+
+// Like Interpret, but stop with a runtime error caused by ctx.Err() when the
+// context is done. The context is checked every CHECK_INTERVAL instructions.
+func (vm *VM) InterpretContext(ctx context.Context, c *chunk.Chunk) error {
+	_, err := vm.runScript(ctx, c)
+	return err
+}
+
+// Run the chunk as the top-level script and return the value it returns,
+// which is nil unless it was compiled with compiler.ReturnLastExpression.
+// The result is pinned on the heap, see chunk.Heap.Pin, so it stays valid
+// while Go code holds it. Unpin it when it is no longer needed.
+func (vm *VM) Run(c *chunk.Chunk) (chunk.Value, error) {
+	return vm.RunContext(context.Background(), c)
+}
+
+// Like Run, with the context handled as by InterpretContext.
+func (vm *VM) RunContext(ctx context.Context, c *chunk.Chunk) (chunk.Value, error) {
+	return vm.pinResult(vm.runScript(ctx, c))
+}
 
-	// hadError := compile(source, &c)
-	// if hadError {
-	// 	return INTERPRET_COMPILE_ERROR
-	// }
+func (vm *VM) runScript(ctx context.Context, c *chunk.Chunk) (result chunk.Value, err error) {
+	// Once the script runs its function refers to the constants.
+	defer vm.heap.UnpinChunk(c)
+	defer vm.startLimits(ctx)()
+	defer vm.recoverStackFault(&err)
 
-	// vm.chunk = &c
-	vm.chunk = c
-	vm.ip = 0
+	function := chunk.NewFunction(&vm.heap)
+	function.Chunk = *c
+
+	// Keep the function in slot zero of the script's frame.
+	vm.push(chunk.NewObjFunction(function))
+	closure := chunk.NewClosure(&vm.heap, function)
+	vm.pop()
+	vm.push(chunk.NewObjClosure(closure))
+	if err := vm.call(closure, 0); err != nil {
+		return chunk.NewNil(), err
+	}
 	return vm.run()
 }
 
-func (vm *VM) run() error {
+// Call a Lox function, native or class from Go. It cannot be used while the
+// VM is running, for example from inside a native function. The result is
+// pinned like the result of Run.
+func (vm *VM) Call(callee chunk.Value, args ...chunk.Value) (chunk.Value, error) {
+	return vm.CallContext(context.Background(), callee, args...)
+}
+
+// Like Call, with the context handled as by InterpretContext.
+func (vm *VM) CallContext(ctx context.Context, callee chunk.Value, args ...chunk.Value) (result chunk.Value, err error) {
+	if vm.frameCount != 0 {
+		return chunk.NewNil(), errors.New("the VM is already running")
+	}
+	if len(args) > math.MaxUint8 {
+		return chunk.NewNil(), fmt.Errorf("can't call with more than %d arguments", math.MaxUint8)
+	}
+	defer vm.startLimits(ctx)()
+	defer vm.recoverStackFault(&err)
+
+	vm.push(callee)
+	for _, arg := range args {
+		vm.push(arg)
+	}
+	if err := vm.callValue(callee, uint8(len(args))); err != nil {
+		return chunk.NewNil(), err
+	}
+	// Natives and classes without an initializer are done without a frame.
+	if vm.frameCount == 0 {
+		return vm.pinResult(vm.pop(), nil)
+	}
+	return vm.pinResult(vm.run())
+}
+
+// Once the VM returns a value only Go code refers to it.
+func (vm *VM) pinResult(result chunk.Value, err error) (chunk.Value, error) {
+	if err == nil {
+		vm.heap.Pin(result)
+	}
+	return result, err
+}
+
+// Turn a stack fault raised by push, pop or peek into a runtime error.
+// Must be deferred by the entry points of the VM.
+func (vm *VM) recoverStackFault(err *error) {
+	if r := recover(); r != nil {
+		fault, ok := r.(stackFault)
+		if !ok {
+			panic(r)
+		}
+		*err = vm.runtimeError("%s", string(fault))
+	}
+}
+
+func (vm *VM) GetGlobal(name string) (chunk.Value, bool) {
+	return vm.globals.GetString(name)
+}
+
+// Define or assign a global variable. The name of a defined global is
+// interned already, so a new string is only made for a new global.
+func (vm *VM) SetGlobal(name string, value chunk.Value) {
+	vm.globals.Set(chunk.CopyString(&vm.heap, []byte(name)), value)
+}
+
+// The frame of the function that is currently executing.
+func (vm *VM) frame() *CallFrame {
+	return &vm.frames[vm.frameCount-1]
+}
+
+// Execute instructions until the outermost frame returns, and return its result.
+func (vm *VM) run() (chunk.Value, error) {
 	for {
-		traceInstruction(vm, vm.ip)
+		traceInstruction(vm, vm.frame().ip)
 		var err error
-		switch chunk.OpCode(vm.readByte()) {
+		vm.instruction = chunk.OpCode(vm.readByte())
+		// A stopped script reports the instruction it did not run.
+		vm.executed++
+		if vm.executed >= vm.nextCheck {
+			if err := vm.checkLimits(); err != nil {
+				return chunk.NewNil(), err
+			}
+		}
+		switch vm.instruction {
 		case chunk.OP_CONSTANT:
 			constant := vm.readConstant()
 			vm.push(constant)
 		case chunk.OP_NEGATE:
 			if !(vm.peek(0).IsNumber()) {
-				vm.runtimeError("Operand must be a number.")
-				err = INTERPRET_RUNTIME_ERROR
+				err = vm.runtimeError("Operand must be a number.")
 			} else {
 				vm.push(chunk.NewNumber(-vm.pop().AsNumber()))
 			}
@@ -101,6 +318,74 @@ func (vm *VM) run() error {
 			vm.push(chunk.NewBool(true))
 		case chunk.OP_FALSE:
 			vm.push(chunk.NewBool(false))
+		case chunk.OP_POP:
+			vm.pop()
+		case chunk.OP_GET_LOCAL:
+			vm.push(vm.stack[vm.readLocal()])
+		case chunk.OP_SET_LOCAL:
+			vm.stack[vm.readLocal()] = vm.peek(0)
+		case chunk.OP_GET_GLOBAL:
+			name := vm.readString()
+			value, ok := vm.globals.Get(name)
+			if !ok {
+				err = vm.runtimeError("Undefined variable '%s'.", name.Bytes)
+			} else {
+				vm.push(value)
+			}
+		case chunk.OP_DEFINE_GLOBAL:
+			name := vm.readString()
+			vm.globals.Set(name, vm.peek(0))
+			vm.pop()
+		case chunk.OP_SET_GLOBAL:
+			name := vm.readString()
+			// Assignment is an expression, leave the value on the stack.
+			if vm.globals.Set(name, vm.peek(0)) {
+				// Undo the accidental definition.
+				vm.globals.Delete(name)
+				err = vm.runtimeError("Undefined variable '%s'.", name.Bytes)
+			}
+		case chunk.OP_GET_UPVALUE:
+			upvalue := vm.readUpvalue()
+			if upvalue.IsOpen() {
+				vm.push(vm.stack[upvalue.Location])
+			} else {
+				vm.push(upvalue.Closed)
+			}
+		case chunk.OP_SET_UPVALUE:
+			upvalue := vm.readUpvalue()
+			if upvalue.IsOpen() {
+				vm.stack[upvalue.Location] = vm.peek(0)
+			} else {
+				upvalue.Closed = vm.peek(0)
+			}
+		case chunk.OP_GET_PROPERTY:
+			if !vm.peek(0).IsInstance() {
+				err = vm.runtimeError("Only instances have properties.")
+				break
+			}
+			instance := vm.peek(0).AsInstance()
+			name := vm.readString()
+			// Fields shadow methods.
+			if value, ok := instance.Fields.Get(name); ok {
+				vm.pop() // Instance.
+				vm.push(value)
+				break
+			}
+			err = vm.bindMethod(instance.Class, name)
+		case chunk.OP_SET_PROPERTY:
+			if !vm.peek(1).IsInstance() {
+				err = vm.runtimeError("Only instances have fields.")
+				break
+			}
+			instance := vm.peek(1).AsInstance()
+			instance.Fields.Set(vm.readString(), vm.peek(0))
+			value := vm.pop()
+			vm.pop() // Instance.
+			vm.push(value)
+		case chunk.OP_GET_SUPER:
+			name := vm.readString()
+			superclass := vm.pop().AsClass()
+			err = vm.bindMethod(superclass, name)
 		case chunk.OP_EQUAL:
 			b := vm.pop()
 			a := vm.pop()
@@ -112,8 +397,10 @@ func (vm *VM) run() error {
 		case chunk.OP_ADD:
 			if vm.peek(0).IsString() || vm.peek(1).IsString() {
 				err = vm.concatenate()
-			} else {
+			} else if vm.peek(0).IsNumber() && vm.peek(1).IsNumber() {
 				err = vm.binary(chunk.NewNumber, PLUS)
+			} else {
+				err = vm.runtimeError("Operands must be two numbers or two strings.")
 			}
 		case chunk.OP_SUBTRACT:
 			err = vm.binary(chunk.NewNumber, SUBTRACT)
@@ -123,72 +410,389 @@ func (vm *VM) run() error {
 			err = vm.binary(chunk.NewNumber, DIVIDE)
 		case chunk.OP_NOT:
 			vm.push(chunk.NewBool(isFalsey(vm.pop())))
+		case chunk.OP_PRINT:
+			chunk.FprintValue(vm.stdout, vm.pop())
+			fmt.Fprintln(vm.stdout)
+		case chunk.OP_JUMP:
+			offset := vm.readShort()
+			vm.frame().ip += int(offset)
+		case chunk.OP_JUMP_IF_FALSE:
+			offset := vm.readShort()
+			if isFalsey(vm.peek(0)) {
+				vm.frame().ip += int(offset)
+			}
+		case chunk.OP_LOOP:
+			offset := vm.readShort()
+			vm.frame().ip -= int(offset)
+		case chunk.OP_CALL:
+			argCount := vm.readByte()
+			err = vm.callValue(vm.peek(argCount), argCount)
+		case chunk.OP_INVOKE:
+			method := vm.readString()
+			argCount := vm.readByte()
+			err = vm.invoke(method, argCount)
+		case chunk.OP_SUPER_INVOKE:
+			method := vm.readString()
+			argCount := vm.readByte()
+			superclass := vm.pop().AsClass()
+			err = vm.invokeFromClass(superclass, method, argCount)
+		case chunk.OP_CLOSURE:
+			function := vm.readConstant().AsFunction()
+			closure := chunk.NewClosure(&vm.heap, function)
+			vm.push(chunk.NewObjClosure(closure))
+			for i := range closure.Upvalues {
+				isLocal := vm.readByte()
+				index := int(vm.readByte())
+				if isLocal == 1 {
+					closure.Upvalues[i] = vm.captureUpvalue(vm.frame().slots + index)
+				} else {
+					closure.Upvalues[i] = vm.frame().closure.Upvalues[index]
+				}
+			}
+		case chunk.OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(vm.stackTop - 1)
+			vm.pop()
+		case chunk.OP_CLASS:
+			name := vm.readConstant().AsString()
+			vm.push(chunk.NewObjClass(chunk.NewClass(&vm.heap, name)))
+		case chunk.OP_METHOD:
+			vm.defineMethod(vm.readString())
+		case chunk.OP_INHERIT:
+			if !vm.peek(1).IsClass() {
+				err = vm.runtimeError("Superclass must be a class.")
+				break
+			}
+			superclass := vm.peek(1).AsClass()
+			subclass := vm.peek(0).AsClass()
+			// Copy down the inherited methods, the subclass's own methods are added later and override them.
+			subclass.Methods.AddAll(&superclass.Methods)
+			vm.pop() // Subclass.
 		case chunk.OP_RETURN:
-			chunk.PrintValue(vm.pop())
-			fmt.Printf("\n")
-			return nil
+			result := vm.pop()
+			slots := vm.frame().slots
+			vm.closeUpvalues(slots)
+			vm.frameCount--
+			if vm.frameCount == 0 {
+				// Discard the script or called function and exit the interpreter.
+				vm.stackTop = slots
+				return result, nil
+			}
+
+			// Discard the callee's slots and leave the result for the caller.
+			vm.stackTop = slots
+			vm.push(result)
 		default:
-			panic("Unknown opcode.")
+			err = vm.runtimeError("Unknown opcode %d.", vm.instruction)
 		}
 		// Break from for loop if we have an error.
 		if err != nil {
-			return err
+			return chunk.NewNil(), err
 		}
+		// Between instructions every live object is reachable from the roots.
+		if vm.heap.ShouldCollect() {
+			if err := vm.collectGarbage(); err != nil {
+				return chunk.NewNil(), err
+			}
+		}
+	}
+}
+
+func (vm *VM) collectGarbage() error {
+	vm.markRoots()
+	vm.heap.Collect()
+	if vm.heap.MaxBytes > 0 && vm.heap.BytesAllocated() > vm.heap.MaxBytes {
+		return vm.runtimeError("Out of memory.")
 	}
+	return nil
 }
 
+// Constants are reached through the functions of the closures in the frames.
+func (vm *VM) markRoots() {
+	for _, value := range vm.stack[:vm.stackTop] {
+		vm.heap.MarkValue(value)
+	}
+	// Slot zero of a method call holds the receiver instead of the closure.
+	for i := 0; i < vm.frameCount; i++ {
+		vm.heap.MarkObject(vm.frames[i].closure)
+	}
+	for upvalue := vm.openUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		vm.heap.MarkObject(upvalue)
+	}
+	vm.heap.MarkTable(&vm.globals)
+	vm.heap.MarkObject(vm.initString)
+}
+
+// Compiled code always ends with a return, but hand written bytecode may
+// run or jump past the end.
 func (vm *VM) readByte() uint8 {
-	i := vm.ip
-	vm.ip++
-	return vm.chunk.Code[i]
+	frame := vm.frame()
+	code := frame.closure.Function.Chunk.Code
+	if frame.ip < 0 || frame.ip >= len(code) {
+		panic(stackFault("Unexpected end of code."))
+	}
+	frame.ip++
+	return code[frame.ip-1]
+}
+
+// Read a 16-bit big endian operand.
+func (vm *VM) readShort() uint16 {
+	high := vm.readByte()
+	return uint16(high)<<8 | uint16(vm.readByte())
 }
 
 func (vm *VM) readConstant() chunk.Value {
-	value := vm.chunk.Constants[vm.readByte()]
-	return value
+	index := int(vm.readByte())
+	constants := vm.frame().closure.Function.Chunk.Constants
+	if index >= len(constants) {
+		panic(stackFault("Constant out of range."))
+	}
+	return constants[index]
+}
+
+// Read the operand of a local variable instruction, and return the index of
+// the variable in the stack.
+func (vm *VM) readLocal() int {
+	index := vm.frame().slots + int(vm.readByte())
+	if index >= vm.stackTop {
+		panic(stackFault("Local slot out of range."))
+	}
+	return index
+}
+
+func (vm *VM) readUpvalue() *chunk.ObjUpvalue {
+	slot := int(vm.readByte())
+	upvalues := vm.frame().closure.Upvalues
+	if slot >= len(upvalues) {
+		panic(stackFault("Upvalue out of range."))
+	}
+	return upvalues[slot]
+}
+
+// Push a new frame for the function, its arguments are already on the stack.
+func (vm *VM) call(closure *chunk.ObjClosure, argCount uint8) error {
+	function := closure.Function
+	if int(argCount) != function.Arity {
+		return vm.runtimeError("Expected %d arguments but got %d.", function.Arity, argCount)
+	}
+
+	if vm.frameCount == FRAMES_MAX {
+		return vm.runtimeError("Stack overflow.")
+	}
+
+	frame := &vm.frames[vm.frameCount]
+	vm.frameCount++
+	frame.closure = closure
+	frame.ip = 0
+	// Slot zero is the function itself, followed by the arguments.
+	frame.slots = vm.stackTop - int(argCount) - 1
+	return nil
+}
+
+func (vm *VM) callValue(callee chunk.Value, argCount uint8) error {
+	if callee.IsObj() {
+		switch callee := callee.AsObject().(type) {
+		case *chunk.ObjClosure:
+			return vm.call(callee, argCount)
+		case *chunk.ObjNative:
+			return vm.callNative(callee, argCount)
+		case *chunk.ObjBoundMethod:
+			// The receiver takes the place of the callee in slot zero.
+			vm.stack[vm.stackTop-int(argCount)-1] = callee.Receiver
+			return vm.call(callee.Method, argCount)
+		case *chunk.ObjClass:
+			// Replace the class with the new instance.
+			vm.stack[vm.stackTop-int(argCount)-1] = chunk.NewObjInstance(chunk.NewInstance(&vm.heap, callee))
+			if initializer, ok := callee.Methods.Get(vm.initString); ok {
+				return vm.call(initializer.AsClosure(), argCount)
+			}
+			if argCount != 0 {
+				return vm.runtimeError("Expected 0 arguments but got %d.", argCount)
+			}
+			return nil
+		}
+	}
+	return vm.runtimeError("Can only call functions and classes.")
+}
+
+func (vm *VM) readString() *chunk.ObjString {
+	return vm.readConstant().AsString()
+}
+
+func (vm *VM) callNative(native *chunk.ObjNative, argCount uint8) error {
+	if native.Arity != -1 && int(argCount) != native.Arity {
+		return vm.runtimeError("Expected %d arguments but got %d.", native.Arity, argCount)
+	}
+
+	args := vm.stack[vm.stackTop-int(argCount) : vm.stackTop]
+	result, err := native.Function(args)
+	if err != nil {
+		runtimeErr := vm.runtimeError("%s", err)
+		runtimeErr.Err = err
+		return runtimeErr
+	}
+
+	// Discard the arguments and the native itself.
+	vm.stackTop -= int(argCount) + 1
+	vm.push(result)
+	return nil
+}
+
+func (vm *VM) invokeFromClass(class *chunk.ObjClass, name *chunk.ObjString, argCount uint8) error {
+	method, ok := class.Methods.Get(name)
+	if !ok {
+		return vm.runtimeError("Undefined property '%s'.", name.Bytes)
+	}
+	return vm.call(method.AsClosure(), argCount)
+}
+
+// Call a method on the receiver below the arguments, without creating a bound method.
+func (vm *VM) invoke(name *chunk.ObjString, argCount uint8) error {
+	receiver := vm.peek(argCount)
+	if !receiver.IsInstance() {
+		return vm.runtimeError("Only instances have methods.")
+	}
+	instance := receiver.AsInstance()
+
+	// A field holding a function is called like any other value.
+	if value, ok := instance.Fields.Get(name); ok {
+		vm.stack[vm.stackTop-int(argCount)-1] = value
+		return vm.callValue(value, argCount)
+	}
+
+	return vm.invokeFromClass(instance.Class, name, argCount)
+}
+
+// Replace the instance on top of the stack with its method bound to it.
+func (vm *VM) bindMethod(class *chunk.ObjClass, name *chunk.ObjString) error {
+	method, ok := class.Methods.Get(name)
+	if !ok {
+		return vm.runtimeError("Undefined property '%s'.", name.Bytes)
+	}
+
+	bound := chunk.NewBoundMethod(&vm.heap, vm.peek(0), method.AsClosure())
+	vm.pop()
+	vm.push(chunk.NewObjBoundMethod(bound))
+	return nil
+}
+
+func (vm *VM) defineMethod(name *chunk.ObjString) {
+	method := vm.peek(0)
+	class := vm.peek(1).AsClass()
+	class.Methods.Set(name, method)
+	vm.pop()
+}
+
+// Return the upvalue for the stack slot, reusing an existing one so that
+// closures capturing the same variable share it.
+func (vm *VM) captureUpvalue(slot int) *chunk.ObjUpvalue {
+	var prevUpvalue *chunk.ObjUpvalue
+	upvalue := vm.openUpvalues
+	for upvalue != nil && upvalue.Location > slot {
+		prevUpvalue = upvalue
+		upvalue = upvalue.Next
+	}
+
+	if upvalue != nil && upvalue.Location == slot {
+		return upvalue
+	}
+
+	createdUpvalue := chunk.NewUpvalue(&vm.heap, slot)
+	createdUpvalue.Next = upvalue
+
+	if prevUpvalue == nil {
+		vm.openUpvalues = createdUpvalue
+	} else {
+		prevUpvalue.Next = createdUpvalue
+	}
+	return createdUpvalue
+}
+
+// Close all open upvalues that point to the given stack slot or above.
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.Location >= last {
+		upvalue := vm.openUpvalues
+		upvalue.Close(vm.stack[upvalue.Location])
+		vm.openUpvalues = upvalue.Next
+	}
 }
 
 func (vm *VM) resetStack() {
 	vm.stackTop = 0
+	vm.frameCount = 0
+	vm.openUpvalues = nil
 }
 
-func (vm *VM) runtimeError(format string, a ...any) {
-	fmt.Fprintf(os.Stderr, format, a...)
-	fmt.Fprintf(os.Stderr, "\n")
+// Capture the message and the call stack, then reset the stack so the VM can
+// be used again.
+func (vm *VM) runtimeError(format string, a ...any) *RuntimeError {
+	err := &RuntimeError{
+		Message: fmt.Sprintf(format, a...),
+		OpCode:  vm.instruction,
+	}
 
-	// Minus one because the interpreter advances past and instruction
-	// before executing it.
-	line := vm.chunk.Lines[vm.ip-1]
-	fmt.Fprintf(os.Stderr, "[line %d] in script\n", line)
+	// Starting with the innermost call.
+	for i := vm.frameCount - 1; i >= 0; i-- {
+		frame := &vm.frames[i]
+		function := frame.closure.Function
+		// Minus one because the interpreter advances past and instruction
+		// before executing it. A frame that did not start yet is at its first
+		// line, one that jumped past the end of its code at its last.
+		var pos chunk.Position
+		if i := min(max(frame.ip-1, 0), len(function.Chunk.Positions)-1); i >= 0 {
+			pos = function.Chunk.Positions[i]
+		}
+		name := ""
+		if function.Name != nil {
+			name = string(function.Name.Bytes)
+		}
+		err.Frames = append(err.Frames, StackFrame{Function: name, Line: pos.Line, Column: pos.Column})
+	}
+	if len(err.Frames) > 0 {
+		err.Line = err.Frames[0].Line
+		err.Column = err.Frames[0].Column
+	}
 	vm.resetStack()
+	return err
 }
 
 func (vm *VM) push(value chunk.Value) {
-	if vm.stackTop == STACK_MAX {
-		msg := fmt.Sprintf("Stack overflow! Max stack size (%d) reached.", STACK_MAX)
-		panic(msg)
+	if vm.stackTop == len(vm.stack) {
+		vm.growStack()
 	}
 	vm.stack[vm.stackTop] = value
 	vm.stackTop++
 }
 
+// Upvalues and frames refer to the stack by index, so it can be moved.
+func (vm *VM) growStack() {
+	if len(vm.stack) >= vm.stackMax {
+		panic(stackFault("Stack overflow."))
+	}
+	stack := make([]chunk.Value, min(max(2*len(vm.stack), STACK_INITIAL), vm.stackMax))
+	copy(stack, vm.stack[:vm.stackTop])
+	vm.stack = stack
+}
+
 func (vm *VM) pop() chunk.Value {
 	if vm.stackTop == 0 {
-		panic("Cannot pop value from an empty stack.")
+		panic(stackFault("Stack underflow."))
 	}
 	vm.stackTop--
 	return vm.stack[vm.stackTop]
 }
 
 func (vm *VM) peek(distance uint8) chunk.Value {
-	return vm.stack[vm.stackTop-distance-1]
+	index := vm.stackTop - int(distance) - 1
+	if index < 0 {
+		panic(stackFault("Stack underflow."))
+	}
+	return vm.stack[index]
 }
 
 // TODO binary op should probably be generic to support multiple value types.
 func (vm *VM) binary(toValue func(chunk.Number) chunk.Value, op BinaryOp) error {
 	if !vm.peek(0).IsNumber() || !vm.peek(1).IsNumber() {
-		vm.runtimeError("Operands must be numbers.")
-		return INTERPRET_RUNTIME_ERROR
+		return vm.runtimeError("Operands must be numbers.")
 	}
 	// Order of pops is important!
 	b := vm.pop().AsNumber()
@@ -200,8 +804,7 @@ func (vm *VM) binary(toValue func(chunk.Number) chunk.Value, op BinaryOp) error
 
 func (vm *VM) binaryBool(toValue func(bool) chunk.Value, op func(chunk.Number, chunk.Number) bool) error {
 	if !vm.peek(0).IsNumber() || !vm.peek(1).IsNumber() {
-		vm.runtimeError("Operands must be numbers.")
-		return INTERPRET_RUNTIME_ERROR
+		return vm.runtimeError("Operands must be numbers.")
 	}
 	// Order of pops is important!
 	b := vm.pop().AsNumber()
@@ -212,15 +815,19 @@ func (vm *VM) binaryBool(toValue func(bool) chunk.Value, op func(chunk.Number, c
 }
 
 func (vm *VM) concatenate() error {
-	// Order of pops is important!
-	b := vm.pop().AsString()
-	a := vm.pop().AsString()
+	b, errB := chunk.Cast[*chunk.ObjString](vm.peek(0))
+	a, errA := chunk.Cast[*chunk.ObjString](vm.peek(1))
+	if errA != nil || errB != nil {
+		return vm.runtimeError("Operands must be two numbers or two strings.")
+	}
+	vm.pop()
+	vm.pop()
 	length := a.Length + b.Length
 	a_b := make([]byte, length)
 	copy(a_b[:a.Length], a.Bytes)
 	copy(a_b[a.Length:], b.Bytes)
-	obj_str := chunk.TakeString(a_b)
-	obj := chunk.NewObj((*chunk.Obj)(unsafe.Pointer(&obj_str)))
+	obj_str := chunk.TakeString(&vm.heap, a_b)
+	obj := chunk.NewObj(obj_str)
 	vm.push(obj)
 	return nil
 }
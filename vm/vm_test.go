@@ -1,12 +1,33 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jeroendm/glox/chunk"
+	"github.com/jeroendm/glox/compiler"
 )
 
+func getGlobal(vm *VM, name string) chunk.Value {
+	value, _ := vm.globals.Get(chunk.CopyString(&vm.heap, []byte(name)))
+	return value
+}
+
+func interpretSource(t *testing.T, vm *VM, source string) error {
+	t.Helper()
+	c := chunk.MakeChunk()
+	if err := compiler.Compile([]byte(source), &c, vm.Heap()); err != nil {
+		t.Fatal(err)
+	}
+	return vm.Interpret(&c)
+}
+
 func TestByteCodeSmall(t *testing.T) {
 	const asm = `.data
 1.2
@@ -20,14 +41,799 @@ add
 constant 2
 divide
 negate
+print
+nil
 return`
 
-	chunk, err := chunk.ParseByteCode(strings.NewReader(asm))
+	vm := MakeVM()
+	chunk, err := chunk.ParseByteCode(strings.NewReader(asm), vm.Heap())
 	if err != nil {
 		t.Fatal(err)
 	}
-	vm := MakeVM()
 	if err := vm.InterpretChunk(&chunk); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestGlobals(t *testing.T) {
+	vm := MakeVM()
+	if err := interpretSource(t, &vm, "var a = 1; var b; b = a + 2;"); err != nil {
+		t.Fatal(err)
+	}
+	if b := getGlobal(&vm, "b"); !b.IsNumber() || b.AsNumber() != 3 {
+		t.Errorf("expected b to be 3")
+	}
+	if err := interpretSource(t, &vm, "a = b * 2;"); err != nil {
+		t.Fatal(err)
+	}
+	if a := getGlobal(&vm, "a"); !a.IsNumber() || a.AsNumber() != 6 {
+		t.Errorf("expected a to be 6")
+	}
+}
+
+func TestUndefinedGlobal(t *testing.T) {
+	vm := MakeVM()
+	if err := interpretSource(t, &vm, "print c;"); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+		t.Errorf("expected runtime error, got %v", err)
+	}
+	if err := interpretSource(t, &vm, "c = 1;"); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+		t.Errorf("expected runtime error, got %v", err)
+	}
+}
+
+// Looking up or assigning a global from Go does not make new strings.
+func TestGlobalsFromGo(t *testing.T) {
+	vm := MakeVM()
+	vm.SetGlobal("a", chunk.NewNumber(1))
+	objects := vm.HeapStats().Objects
+	if _, ok := vm.GetGlobal("undefined"); ok {
+		t.Errorf("expected undefined to be undefined")
+	}
+	vm.SetGlobal("a", chunk.NewNumber(2))
+	if a, ok := vm.GetGlobal("a"); !ok || a.AsNumber() != 2 {
+		t.Errorf("expected a to be 2, got %v", a)
+	}
+	if actual := vm.HeapStats().Objects; actual != objects {
+		t.Errorf("expected %d objects, got %d", objects, actual)
+	}
+}
+
+func TestBlockScope(t *testing.T) {
+	vm := MakeVM()
+	source := `
+	var a = 1;
+	var b;
+	{
+		var a = 2;
+		{
+			var c = a + 1;
+			b = c;
+		}
+	}
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if b := getGlobal(&vm, "b"); !b.IsNumber() || b.AsNumber() != 3 {
+		t.Errorf("expected b to be 3")
+	}
+	if a := getGlobal(&vm, "a"); !a.IsNumber() || a.AsNumber() != 1 {
+		t.Errorf("expected a to be 1")
+	}
+	if vm.stackTop != 0 {
+		t.Errorf("expected empty stack, got %d values", vm.stackTop)
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	vm := MakeVM()
+	source := `
+	var sum = 0;
+	for (var i = 0; i < 5; i = i + 1) {
+		if (i == 2) sum = sum + 100; else sum = sum + i;
+	}
+	var n = 0;
+	while (n < 3) n = n + 1;
+	var a = nil or "default";
+	var b = 1 and false;
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if sum := getGlobal(&vm, "sum"); !sum.IsNumber() || sum.AsNumber() != 108 {
+		t.Errorf("expected sum to be 108")
+	}
+	if n := getGlobal(&vm, "n"); !n.IsNumber() || n.AsNumber() != 3 {
+		t.Errorf("expected n to be 3")
+	}
+	if a := getGlobal(&vm, "a"); !a.IsString() || a.AsGoString() != "default" {
+		t.Errorf("expected a to be 'default'")
+	}
+	if b := getGlobal(&vm, "b"); !b.IsBool() || b.AsBool() {
+		t.Errorf("expected b to be false")
+	}
+	if vm.stackTop != 0 {
+		t.Errorf("expected empty stack, got %d values", vm.stackTop)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	vm := MakeVM()
+	source := `
+	fun fib(n) {
+		if (n < 2) return n;
+		return fib(n - 2) + fib(n - 1);
+	}
+	fun noReturn() {}
+	var a = fib(10);
+	var b = noReturn();
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if a := getGlobal(&vm, "a"); !a.IsNumber() || a.AsNumber() != 55 {
+		t.Errorf("expected a to be 55")
+	}
+	if b := getGlobal(&vm, "b"); !b.IsNil() {
+		t.Errorf("expected b to be nil")
+	}
+	if vm.stackTop != 0 {
+		t.Errorf("expected empty stack, got %d values", vm.stackTop)
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	sources := []string{
+		"fun f(a) {} f();",
+		"fun f() {} f(1, 2);",
+		"var a = 1; a();",
+		"\"str\"();",
+		"fun f() { f(); } f();",
+	}
+	for _, source := range sources {
+		vm := MakeVM()
+		if err := interpretSource(t, &vm, source); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+			t.Errorf("expected runtime error for %q, got %v", source, err)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	vm := MakeVM()
+	source := `
+	fun makeCounter() {
+		var i = 0;
+		fun count() {
+			i = i + 1;
+			return i;
+		}
+		return count;
+	}
+	var counter = makeCounter();
+	counter();
+	var a = counter();
+
+	var get;
+	var set;
+	{
+		var shared = "before";
+		fun g() { return shared; }
+		fun s(value) { shared = value; }
+		get = g;
+		set = s;
+	}
+	set("after");
+	var b = get();
+
+	fun outer() {
+		var x = "outer";
+		fun middle() {
+			fun inner() { return x; }
+			return inner;
+		}
+		return middle;
+	}
+	var c = outer()()();
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if a := getGlobal(&vm, "a"); !a.IsNumber() || a.AsNumber() != 2 {
+		t.Errorf("expected a to be 2")
+	}
+	if b := getGlobal(&vm, "b"); !b.IsString() || b.AsGoString() != "after" {
+		t.Errorf("expected b to be 'after'")
+	}
+	if c := getGlobal(&vm, "c"); !c.IsString() || c.AsGoString() != "outer" {
+		t.Errorf("expected c to be 'outer'")
+	}
+	if vm.openUpvalues != nil {
+		t.Errorf("expected all upvalues to be closed")
+	}
+}
+
+func TestFields(t *testing.T) {
+	vm := MakeVM()
+	source := `
+	class Pair {}
+	var pair = Pair();
+	pair.first = 1;
+	pair.second = 2;
+	var sum = pair.first + pair.second;
+	pair.first = pair.second = 5;
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if sum := getGlobal(&vm, "sum"); !sum.IsNumber() || sum.AsNumber() != 3 {
+		t.Errorf("expected sum to be 3")
+	}
+	pair := getGlobal(&vm, "pair")
+	if !pair.IsInstance() || pair.AsInstance().Class.Name.Length != 4 {
+		t.Fatalf("expected pair to be a Pair instance")
+	}
+	if first, _ := pair.AsInstance().Fields.Get(chunk.CopyString(&vm.heap, []byte("first"))); !first.IsNumber() || first.AsNumber() != 5 {
+		t.Errorf("expected pair.first to be 5")
+	}
+}
+
+func TestPropertyErrors(t *testing.T) {
+	sources := []string{
+		"var a = 1; a.x;",
+		"var a = \"str\"; a.x = 1;",
+		"class A {} A().missing;",
+		"class A {} A(1);",
+	}
+	for _, source := range sources {
+		vm := MakeVM()
+		if err := interpretSource(t, &vm, source); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+			t.Errorf("expected runtime error for %q, got %v", source, err)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	vm := MakeVM()
+	source := `
+	class Counter {
+		init(start) {
+			this.count = start;
+			return;
+		}
+		increment() {
+			this.count = this.count + 1;
+			return this;
+		}
+		get() { return this.count; }
+	}
+	var counter = Counter(5);
+	counter.increment().increment();
+	var a = counter.get();
+	var method = counter.get;
+	counter.increment();
+	var b = method();
+	var c = counter.init(0) == counter;
+
+	class Callback {
+		init() {
+			fun f() { return this; }
+			this.f = f;
+		}
+	}
+	var callback = Callback();
+	var d = callback.f() == callback;
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if a := getGlobal(&vm, "a"); !a.IsNumber() || a.AsNumber() != 7 {
+		t.Errorf("expected a to be 7")
+	}
+	if b := getGlobal(&vm, "b"); !b.IsNumber() || b.AsNumber() != 8 {
+		t.Errorf("expected b to be 8")
+	}
+	if c := getGlobal(&vm, "c"); !c.IsBool() || !c.AsBool() {
+		t.Errorf("expected init to return the instance")
+	}
+	if d := getGlobal(&vm, "d"); !d.IsBool() || !d.AsBool() {
+		t.Errorf("expected closure to capture this")
+	}
+}
+
+func TestMethodErrors(t *testing.T) {
+	sources := []string{
+		"class A { init(a) {} } A();",
+		"class A {} A().missing();",
+		"var a = 1; a.method();",
+	}
+	for _, source := range sources {
+		vm := MakeVM()
+		if err := interpretSource(t, &vm, source); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+			t.Errorf("expected runtime error for %q, got %v", source, err)
+		}
+	}
+}
+
+func TestInheritance(t *testing.T) {
+	vm := MakeVM()
+	source := `
+	class A {
+		init(name) { this.name = name; }
+		greet() { return "A " + this.name; }
+		kind() { return "A"; }
+	}
+	class B < A {
+		init(name) { super.init(name + "!"); }
+		kind() { return "B"; }
+		parentKind() {
+			var method = super.kind;
+			return method();
+		}
+	}
+	class C < B {}
+	var c = C("c");
+	var a = c.greet();
+	var b = c.kind();
+	var d = c.parentKind();
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if a := getGlobal(&vm, "a"); !a.IsString() || a.AsGoString() != "A c!" {
+		t.Errorf("expected a to be 'A c!'")
+	}
+	if b := getGlobal(&vm, "b"); !b.IsString() || b.AsGoString() != "B" {
+		t.Errorf("expected b to be 'B'")
+	}
+	if d := getGlobal(&vm, "d"); !d.IsString() || d.AsGoString() != "A" {
+		t.Errorf("expected d to be 'A'")
+	}
+}
+
+func TestInheritanceErrors(t *testing.T) {
+	sources := []string{
+		"var A = 1; class B < A {}",
+		"class A {} class B < A { m() { return super.missing; } } B().m();",
+		"class A {} class B < A { m() { super.missing(); } } B().m();",
+	}
+	for _, source := range sources {
+		vm := MakeVM()
+		if err := interpretSource(t, &vm, source); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+			t.Errorf("expected runtime error for %q, got %v", source, err)
+		}
+	}
+}
+
+func TestNatives(t *testing.T) {
+	vm := MakeVM()
+	vm.DefineNative("add", 2, func(args []chunk.Value) (chunk.Value, error) {
+		return chunk.NewNumber(args[0].AsNumber() + args[1].AsNumber()), nil
+	})
+	vm.DefineNative("count", -1, func(args []chunk.Value) (chunk.Value, error) {
+		return chunk.NewNumber(chunk.Number(len(args))), nil
+	})
+	source := `
+	var a = add(1, 2);
+	var b = count(1, 2, 3) + count();
+	var c = clock() >= 0;
+	`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	if a := getGlobal(&vm, "a"); !a.IsNumber() || a.AsNumber() != 3 {
+		t.Errorf("expected a to be 3")
+	}
+	if b := getGlobal(&vm, "b"); !b.IsNumber() || b.AsNumber() != 3 {
+		t.Errorf("expected b to be 3")
+	}
+	if c := getGlobal(&vm, "c"); !c.IsBool() || !c.AsBool() {
+		t.Errorf("expected clock to return a non-negative number")
+	}
+	if vm.stackTop != 0 {
+		t.Errorf("expected empty stack, got %d values", vm.stackTop)
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	vm := MakeVM()
+	failure := errors.New("native failed")
+	vm.DefineNative("fail", 0, func(args []chunk.Value) (chunk.Value, error) {
+		return chunk.NewNil(), failure
+	})
+	if err := interpretSource(t, &vm, "fail();"); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+		t.Errorf("expected runtime error, got %v", err)
+	} else if !errors.Is(err, failure) {
+		t.Errorf("expected the native's error as the cause, got %v", err)
+	}
+	if err := interpretSource(t, &vm, "clock(1);"); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+		t.Errorf("expected runtime error, got %v", err)
+	}
+}
+
+// A Lox loop that runs b.N times, the fixed cost of starting the script is
+// spread over the iterations so allocs/op shows what a single iteration allocates.
+func BenchmarkNumericLoop(b *testing.B) {
+	benchmarkNumericLoop(b, context.Background())
+}
+
+// Compare with BenchmarkNumericLoop for the cost of checking the limits.
+func BenchmarkNumericLoopWithLimits(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	benchmarkNumericLoop(b, ctx, InstructionBudget(math.MaxInt64-1), Timeout(time.Hour))
+}
+
+func benchmarkNumericLoop(b *testing.B, ctx context.Context, options ...Option) {
+	vm := MakeVM(options...)
+	c := chunk.MakeChunk()
+	source := fmt.Sprintf("{ var sum = 0; for (var i = 0; i < %d; i = i + 1) { sum = sum + i * 2; } }", b.N)
+	if err := compiler.Compile([]byte(source), &c, vm.Heap()); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	if err := vm.InterpretContext(ctx, &c); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestAddMixedTypes(t *testing.T) {
+	sources := []string{
+		"\"a\" + 1;",
+		"1 + \"a\";",
+		"nil + 1;",
+		"class A {} A() + \"a\";",
+	}
+	for _, source := range sources {
+		vm := MakeVM()
+		if err := interpretSource(t, &vm, source); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+			t.Errorf("expected runtime error for %q, got %v", source, err)
+		}
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	vm := MakeVM(MaxHeapBytes(64 * 1024))
+	source := `
+class Node { init(next) { this.next = next; } }
+var kept = Node(nil);
+for (var i = 0; i < 10000; i = i + 1) {
+  var garbage = Node(Node(nil));
+  var name = "node" + "s";
+}
+kept.next = "still here";
+`
+	if err := interpretSource(t, &vm, source); err != nil {
+		t.Fatal(err)
+	}
+	stats := vm.HeapStats()
+	if stats.Collections == 0 {
+		t.Errorf("expected the garbage collector to run")
+	}
+	if stats.BytesAllocated > 64*1024 {
+		t.Errorf("expected at most 64KiB on the heap, got %d bytes", stats.BytesAllocated)
+	}
+	next, _ := getGlobal(&vm, "kept").AsInstance().Fields.Get(chunk.CopyString(&vm.heap, []byte("next")))
+	if !next.IsString() || next.AsGoString() != "still here" {
+		t.Errorf("expected reachable objects to survive a collection")
+	}
+}
+
+// Chunks waiting to run and results held by Go code are roots.
+func TestPinnedAcrossCollections(t *testing.T) {
+	vm := MakeVM()
+	pending := chunk.MakeChunk()
+	if err := compiler.Compile([]byte("var pendingName = 1;"), &pending, vm.Heap()); err != nil {
+		t.Fatal(err)
+	}
+	c := chunk.MakeChunk()
+	if err := compiler.Compile([]byte(`"result" + "string";`), &c, vm.Heap(), compiler.ReturnLastExpression()); err != nil {
+		t.Fatal(err)
+	}
+	result, err := vm.Run(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := vm.GetGlobal("pendingName"); !ok || value.AsNumber() != 1 {
+		t.Errorf("expected the global defined by the pending chunk, got %v", value)
+	}
+	if chunk.CopyString(&vm.heap, []byte("resultstring")) != result.AsString() {
+		t.Errorf("expected the result to stay interned")
+	}
+}
+
+// Interpret unpins the chunk and does not pin the result, nothing refers to
+// them once the script is done.
+func TestInterpretReleasesChunk(t *testing.T) {
+	vm := MakeVM()
+	objects := vm.HeapStats().Objects
+	c := chunk.MakeChunk()
+	if err := compiler.Compile([]byte(`"released" + "string";`), &c, vm.Heap(), compiler.ReturnLastExpression()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(&c); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if actual := vm.HeapStats().Objects; actual != objects {
+		t.Errorf("expected %d objects after the script, got %d", objects, actual)
+	}
+}
+
+func TestOutOfMemory(t *testing.T) {
+	vm := MakeVM(MaxHeapBytes(64 * 1024))
+	source := `
+class Node { init(next) { this.next = next; } }
+fun grow() {
+  var head = nil;
+  while (true) head = Node(head);
+}
+grow();
+`
+	if err := interpretSource(t, &vm, source); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+		t.Fatalf("expected runtime error, got %v", err)
+	}
+
+	// The list is unreachable once the error unwinds the stack, the VM can be used again.
+	if err := interpretSource(t, &vm, "var done = true;"); err != nil {
+		t.Fatal(err)
+	}
+	if done := getGlobal(&vm, "done"); !done.IsBool() || !done.AsBool() {
+		t.Errorf("expected done to be true")
+	}
+}
+
+// a + (a + (a + ... )) keeps every operand on the stack until the innermost addition.
+// The operands are locals, each global would need a constant.
+func nestedSum(depth int) string {
+	return "var sum; { var a = 1; sum = " + strings.Repeat("a + (", depth) + "a" + strings.Repeat(")", depth) + "; }"
+}
+
+func TestStackGrows(t *testing.T) {
+	vm := MakeVM()
+	if err := interpretSource(t, &vm, nestedSum(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.stack) <= STACK_INITIAL {
+		t.Errorf("expected the stack to grow past %d values", STACK_INITIAL)
+	}
+	if vm.stackTop != 0 {
+		t.Errorf("expected empty stack, got %d values", vm.stackTop)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	vm := MakeVM(MaxStackSize(100))
+	if err := interpretSource(t, &vm, nestedSum(200)); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+		t.Fatalf("expected runtime error, got %v", err)
+	}
+	// The VM is usable after the error.
+	if err := interpretSource(t, &vm, nestedSum(50)); err != nil {
+		t.Fatal(err)
+	}
+	if sum := getGlobal(&vm, "sum"); !sum.IsNumber() || sum.AsNumber() != 51 {
+		t.Errorf("expected sum to be 51")
+	}
+}
+
+func TestMaxStackSizeDefault(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		vm := MakeVM(MaxStackSize(n))
+		if vm.stackMax != STACK_MAX {
+			t.Errorf("MaxStackSize(%d): expected the default of %d, got %d", n, STACK_MAX, vm.stackMax)
+		}
+		if err := interpretSource(t, &vm, nestedSum(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStackUnderflow(t *testing.T) {
+	programs := []string{
+		"pop\npop\nnil\nreturn",
+		"add\nnil\nreturn",
+		"pop\nreturn",
+	}
+	for _, text := range programs {
+		vm := MakeVM()
+		c, err := chunk.ParseByteCode(strings.NewReader(".data\n.text\n"+text), vm.Heap())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Interpret(&c); !errors.Is(err, INTERPRET_RUNTIME_ERROR) {
+			t.Errorf("expected runtime error for %q, got %v", text, err)
+		}
+	}
+}
+
+// Hand written bytecode can refer to operands that do not exist.
+func TestBadOperands(t *testing.T) {
+	programs := []struct {
+		text    string
+		message string
+	}{
+		{"get_local 200\nreturn", "Local slot out of range."},
+		{"nil\nset_local 200\nreturn", "Local slot out of range."},
+		{"get_upvalue 0\nreturn", "Upvalue out of range."},
+		{"constant 5\nreturn", "Constant out of range."},
+		{"get_global 0\nreturn", "Constant out of range."},
+		{"nil\npop", "Unexpected end of code."},
+		{"jump 100\nnil\nreturn", "Unexpected end of code."},
+		{"loop 100\nnil\nreturn", "Unexpected end of code."},
+		{"", "Unexpected end of code."},
+	}
+	for _, program := range programs {
+		vm := MakeVM()
+		c, err := chunk.ParseByteCode(strings.NewReader(".data\n.text\n"+program.text), vm.Heap())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runtimeErr *RuntimeError
+		if err := vm.Interpret(&c); !errors.As(err, &runtimeErr) || runtimeErr.Message != program.message {
+			t.Errorf("expected %q for %q, got %v", program.message, program.text, err)
+		}
+	}
+}
+
+func TestRuntimeErrorTrace(t *testing.T) {
+	vm := MakeVM()
+	source := `fun a() { b(); }
+fun b() {
+  c();
+}
+fun c() {
+  return 1 + nil;
+}
+
+a();`
+	err := interpretSource(t, &vm, source)
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected a *RuntimeError, got %v", err)
+	}
+	if runtimeErr.Message != "Operands must be two numbers or two strings." {
+		t.Errorf("unexpected message %q", runtimeErr.Message)
+	}
+	if runtimeErr.Line != 6 {
+		t.Errorf("expected line 6, got %d", runtimeErr.Line)
+	}
+	if runtimeErr.OpCode != chunk.OP_ADD {
+		t.Errorf("expected the error at OP_ADD, got %d", runtimeErr.OpCode)
+	}
+	if expected := "6:12: Operands must be two numbers or two strings."; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+	// Operators and calls are positioned at the operator and the '('.
+	expected := []StackFrame{{"c", 6, 12}, {"b", 3, 4}, {"a", 1, 12}, {"", 9, 2}}
+	if fmt.Sprint(runtimeErr.Frames) != fmt.Sprint(expected) {
+		t.Errorf("expected frames %v, got %v", expected, runtimeErr.Frames)
+	}
+
+	const trace = `Operands must be two numbers or two strings.
+[line 6:12] in c()
+[line 3:4] in b()
+[line 1:12] in a()
+[line 9:2] in script
+`
+	if formatted := Format(err); formatted != trace {
+		t.Errorf("expected trace\n%s\ngot\n%s", trace, formatted)
+	}
+
+	// Assembled bytecode has no columns.
+	c, err := chunk.ParseByteCode(strings.NewReader(".data\n.text\nnil\nnegate\n"), vm.Heap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted, expected := Format(vm.Interpret(&c)), "Operand must be a number.\n[line 3] in script\n"; formatted != expected {
+		t.Errorf("expected trace %q, got %q", expected, formatted)
+	}
+}
+
+func TestRuntimeErrorPositions(t *testing.T) {
+	inputs := []struct {
+		source   string
+		expected string
+	}{
+		{"print 1 - nil;", "1:9: Operands must be numbers."},
+		{"var a = 1;\nprint a +\n  -\"x\";", "3:3: Operand must be a number."},
+		{"print undefined;", "1:7: Undefined variable 'undefined'."},
+		{"var a = 1;\nundefined = a;", "2:1: Undefined variable 'undefined'."},
+		{"var a = 1;\na.field = 2;", "2:3: Only instances have fields."},
+		{"class A {}\nA().method(1, 2);", "2:5: Undefined property 'method'."},
+		{"var f = 1;\nf(\n1);", "2:2: Can only call functions and classes."},
+	}
+	for _, input := range inputs {
+		vm := MakeVM()
+		err := interpretSource(t, &vm, input.source)
+		if err == nil || err.Error() != input.expected {
+			t.Errorf("expected %q for %q, got %v", input.expected, input.source, err)
+		}
+	}
+}
+
+func TestStdout(t *testing.T) {
+	var out bytes.Buffer
+	vm := MakeVM(Stdout(&out))
+	if err := interpretSource(t, &vm, "print 1 + 2; print \"a\" + \"b\"; print nil;"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "3\nab\nnil\n"; out.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+}
+
+func TestInstructionBudget(t *testing.T) {
+	// Defining a is 2 instructions, the implicit return 2 more.
+	vm := MakeVM(InstructionBudget(4))
+	if err := interpretSource(t, &vm, "var a = 1;"); err != nil {
+		t.Fatal(err)
+	}
+	// The budget is per call.
+	if err := interpretSource(t, &vm, "var b = 2;"); err != nil {
+		t.Fatal(err)
+	}
+	vm = MakeVM(InstructionBudget(3))
+	if err := interpretSource(t, &vm, "var a = 1;"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+
+	vm = MakeVM(InstructionBudget(10_000))
+	err := interpretSource(t, &vm, "var a = 1;\nwhile (true) {\n  a = a + 1;\n}")
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+	// The jump back is at the closing brace.
+	if runtimeErr.Line < 2 || runtimeErr.Line > 4 {
+		t.Errorf("expected the error inside the loop, got line %d", runtimeErr.Line)
+	}
+	if a := getGlobal(&vm, "a"); a.AsNumber() < 1000 {
+		t.Errorf("expected the loop to run until the budget was used, got a = %g", a.AsNumber())
+	}
+
+	// The error is at the first instruction over the budget.
+	vm = MakeVM(InstructionBudget(3))
+	c, err := chunk.ParseByteCode(strings.NewReader(".data\n.text\nnil\npop\ntrue\npop\nnil\nreturn"), vm.Heap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Interpret(&c); !errors.As(err, &runtimeErr) || runtimeErr.OpCode != chunk.OP_POP || runtimeErr.Line != c.Positions[3].Line {
+		t.Errorf("expected the error at the second pop on line %d, got %+v", c.Positions[3].Line, err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	vm := MakeVM()
+	c := chunk.MakeChunk()
+	if err := compiler.Compile([]byte("while (true) {}"), &c, vm.Heap()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := vm.InterpretContext(ctx, &c)
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if runtimeErr.Line != 1 {
+		t.Errorf("expected the error on line 1, got %d", runtimeErr.Line)
+	}
+	if errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected only context.Canceled")
+	}
+
+	vm = MakeVM(Timeout(10 * time.Millisecond))
+	if err := vm.Interpret(&c); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}